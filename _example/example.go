@@ -20,8 +20,7 @@ func main() {
 	var s string
 	if strings.HasPrefix(*server, "unix://") {
 		s = (*server)[7:]
-		os.Remove(s)
-		l, e = net.Listen("unix", s)
+		l, e = uwsgi.SafeListenUnix(s)
 		os.Chmod(s, 0666)
 	} else if strings.HasPrefix(*server, "tcp://") {
 		s = (*server)[6:]
@@ -36,20 +35,18 @@ func main() {
 	}
 	root, _ := filepath.Split(os.Args[0])
 	root, _ = filepath.Abs(root)
-	http.Serve(&uwsgi.Listener{l}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		script_name := r.Header.Get("SCRIPT_NAME")
+	ul := uwsgi.NewListener(l, uwsgi.WithStripScriptName())
+	server := &http.Server{ConnContext: ul.ConnContext, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
-		if strings.HasPrefix(path, script_name) {
-			path = path[len(script_name):]
-		}
 		file := filepath.Join(root, filepath.FromSlash(path))
 		f, e := os.Stat(file)
 		if e == nil && f.IsDir() && len(path) > 0 && path[len(path)-1] != '/' {
-			w.Header().Set("Location", r.URL.Path+"/")
+			w.Header().Set("Location", uwsgi.ScriptName(r)+r.URL.Path+"/")
 			w.WriteHeader(http.StatusFound)
 			return
 		}
 
 		http.ServeFile(w, r, file)
-	}))
+	})}
+	server.Serve(ul)
 }
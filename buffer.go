@@ -0,0 +1,43 @@
+package uwsgi
+
+import (
+	"sync"
+)
+
+// bufClasses are the capacities of the pooled buffers. The vars are 64KiB at
+// most, and the header block reconstructed from them is a little larger.
+var bufClasses = [...]int{2 << 10, 8 << 10, 32 << 10, 128 << 10}
+
+var bufPools [len(bufClasses)]sync.Pool
+
+// getBuf returns an empty buffer of the capacity size at least, from the pool
+// of the size class. The buffer should be given back by putBuf once it is not
+// referred anymore.
+func getBuf(size int) *[]byte {
+	for i, class := range bufClasses {
+		if size > class {
+			continue
+		}
+		if b, ok := bufPools[i].Get().(*[]byte); ok {
+			*b = (*b)[:0]
+			return b
+		}
+		b := make([]byte, 0, class)
+		return &b
+	}
+	b := make([]byte, 0, size)
+	return &b
+}
+
+// putBuf give the buffer back to the pool of the largest class it can hold.
+// The buffer beyond the classes is left to GC.
+func putBuf(b *[]byte) {
+	for i := len(bufClasses) - 1; i >= 0; i-- {
+		if cap(*b) >= bufClasses[i] {
+			if cap(*b) <= 2*bufClasses[len(bufClasses)-1] {
+				bufPools[i].Put(b)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package uwsgi
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBufPool(t *testing.T) {
+	for _, size := range []int{0, 100, 2 << 10, 3 << 10, 64 << 10, 200 << 10} {
+		b := getBuf(size)
+		if len(*b) != 0 || cap(*b) < size {
+			t.Errorf("Unexpected buffer for %d; got len %d cap %d", size, len(*b), cap(*b))
+		}
+		*b = append(*b, "dirty"...)
+		putBuf(b)
+		if b := getBuf(size); len(*b) != 0 || cap(*b) < size {
+			t.Errorf("Unexpected reused buffer for %d; got len %d cap %d", size, len(*b), cap(*b))
+		}
+	}
+}
+
+// memListener accepts the connections which yield the packet.
+type memListener struct {
+	packet []byte
+}
+
+func (l *memListener) Accept() (net.Conn, error) { return &memConn{bytes.NewReader(l.packet)}, nil }
+func (l *memListener) Close() error              { return nil }
+func (l *memListener) Addr() net.Addr            { return rwAddr{} }
+
+type memConn struct {
+	*bytes.Reader
+}
+
+func (c *memConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *memConn) Close() error                       { return nil }
+func (c *memConn) LocalAddr() net.Addr                { return rwAddr{} }
+func (c *memConn) RemoteAddr() net.Addr               { return rwAddr{} }
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// BenchmarkAccept reports the allocations to accept a connection and read
+// the reconstructed request from it.
+func BenchmarkAccept(b *testing.B) {
+	var packet bytes.Buffer
+	WritePacket(&packet, 0, 0, benchmarkEnv(40))
+	l := &Listener{Listener: &memListener{packet: packet.Bytes()}, InlineParse: true}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		c, err := l.Accept()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, c); err != nil {
+			b.Fatal(err)
+		}
+		c.Close()
+	}
+}
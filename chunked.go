@@ -0,0 +1,60 @@
+package uwsgi
+
+import (
+	"io"
+	"strconv"
+)
+
+// unboundedBody reports whether the request may have the body without length.
+// See Listener.UnboundedBody.
+func unboundedBody(env map[string][]string) bool {
+	if hasVar(env, "CONTENT_LENGTH") || hasVar(env, "HTTP_CONTENT_LENGTH") || hasVar(env, "HTTP_TRANSFER_ENCODING") {
+		return false
+	}
+	switch firstVar(env, "REQUEST_METHOD") {
+	case "POST", "PUT", "PATCH":
+		return true
+	}
+	return false
+}
+
+// chunkedBody frames the body of unknown length in the chunked encoding, so
+// http.Server reads it until EOF.
+type chunkedBody struct {
+	c   *Conn
+	raw []byte
+	buf []byte // framed, not returned yet
+	off int
+	err error
+}
+
+func (cb *chunkedBody) Read(b []byte) (int, error) {
+	for cb.off == len(cb.buf) {
+		if cb.err != nil {
+			return 0, cb.err
+		}
+		cb.fill()
+	}
+	n := copy(b, cb.buf[cb.off:])
+	cb.off += n
+	return n, nil
+}
+
+func (cb *chunkedBody) fill() {
+	if cb.raw == nil {
+		cb.raw = make([]byte, 4096)
+	}
+	n, err := cb.c.readBody(cb.raw)
+	cb.buf = cb.buf[:0]
+	cb.off = 0
+	if n > 0 {
+		cb.buf = strconv.AppendInt(cb.buf, int64(n), 16)
+		cb.buf = append(cb.buf, "\r\n"...)
+		cb.buf = append(cb.buf, cb.raw[:n]...)
+		cb.buf = append(cb.buf, "\r\n"...)
+	}
+	if err == io.EOF {
+		cb.buf = append(cb.buf, "0\r\n\r\n"...)
+	}
+	cb.err = err
+}
@@ -0,0 +1,61 @@
+package uwsgi
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnboundedBody(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read body error: %v", err)
+		}
+		w.Write(b)
+	})
+	m := map[string]string{
+		"REQUEST_METHOD":  "POST",
+		"REQUEST_URI":     "/upload",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"CONTENT_LENGTH":  "",
+	}
+	content := strings.Repeat("0123456789", 1000)
+
+	for _, unbounded := range []bool{false, true} {
+		addr := startListener(t, &Listener{UnboundedBody: unbounded}, echo)
+		fd, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		defer fd.Close()
+		fd.SetDeadline(time.Now().Add(5 * time.Second))
+		writePacket(fd, m)
+
+		expected := ""
+		if unbounded {
+			// The late part is not lost, and the body ends when the peer
+			// shuts down writing.
+			fd.Write([]byte(content[:10]))
+			time.Sleep(300 * time.Millisecond)
+			fd.Write([]byte(content[10:]))
+			fd.(*net.TCPConn).CloseWrite()
+			expected = content
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+		if err != nil {
+			t.Fatalf("read response error (UnboundedBody=%v): %v", unbounded, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != expected {
+			t.Errorf("Unexpected body with UnboundedBody=%v; got %d bytes; expected %d bytes", unbounded, len(body), len(expected))
+		}
+	}
+}
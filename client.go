@@ -0,0 +1,50 @@
+package uwsgi
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Client send uwsgi requests to the uwsgi server. Unlike Passenger and
+// Transport, the vars are given as is, so the client can talk to any uwsgi
+// server for integration tests or scripts.
+type Client struct {
+	Net  string
+	Addr string
+}
+
+// Send send the vars and the body, and returns the response. The body may
+// be nil. The caller should close the body of the response.
+func (c *Client) Send(vars map[string]string, body io.Reader) (*http.Response, error) {
+	conn, err := net.Dial(c.Net, c.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(map[string][]string, len(vars))
+	for k, v := range vars {
+		header[k] = []string{v}
+	}
+	if err := WritePacket(conn, ModifierHTTP, 0, header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if body != nil {
+		if _, err := io.Copy(conn, body); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// The method is needed to know whether the response has body.
+	req := &http.Request{Method: vars["REQUEST_METHOD"]}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body = &connBody{ReadCloser: res.Body, conn: conn}
+	return res, nil
+}
@@ -0,0 +1,41 @@
+package uwsgi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientSend(t *testing.T) {
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(r.URL.Path + ":" + string(body)))
+	}))
+
+	client := &Client{Net: "tcp", Addr: addr}
+	res, err := client.Send(map[string]string{
+		"REQUEST_METHOD":  "POST",
+		"REQUEST_URI":     "/send",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"CONTENT_LENGTH":  "5",
+	}, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		t.Errorf("Unexpected status; got %d; expected %d", res.StatusCode, http.StatusAccepted)
+	}
+	if got := res.Header.Get("X-Method"); got != "POST" {
+		t.Errorf("Unexpected X-Method; got %q; expected %q", got, "POST")
+	}
+	if string(body) != "/send:hello" {
+		t.Errorf("Unexpected body; got %q; expected %q", string(body), "/send:hello")
+	}
+}
@@ -0,0 +1,284 @@
+package uwsgi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// contextKey is a value for use with context.WithValue.
+type contextKey struct {
+	name string
+}
+
+var (
+	connContextKey      = &contextKey{"uwsgi-conn"}
+	requestIDContextKey = &contextKey{"uwsgi-request-id"}
+	varsContextKey      = &contextKey{"uwsgi-vars"}
+	acceptedContextKey  = &contextKey{"uwsgi-accepted"}
+	deadlineContextKey  = &contextKey{"uwsgi-deadline"}
+)
+
+// ConnContext should be set to ConnContext of http.Server to make the
+// connection available to Handler.
+//
+//	ul := &uwsgi.Listener{Listener: l}
+//	server := &http.Server{Handler: ul.Handler(handler), ConnContext: ul.ConnContext}
+//	server.Serve(ul)
+func (l *Listener) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if uc, ok := c.(*Conn); ok {
+		ctx = context.WithValue(ctx, connContextKey, uc)
+	}
+	return ctx
+}
+
+// Handler wrap the handler to attach the values from the uwsgi vars to the
+// request context. r.RemoteAddr is set to REMOTE_ADDR and REMOTE_PORT, i.e.
+// the client of the front-end. When the request turned out to be HTTPS (see
+// Listener.TrustedProxies), r.URL.Scheme is set to "https" and r.TLS has
+// best-effort TLS connection state. This requires ConnContext.
+func (l *Listener) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.Metrics != nil {
+			mw := &metricsWriter{ResponseWriter: w}
+			start := time.Now()
+			defer func() {
+				l.Metrics.OnRequestComplete(r.Method, r.RequestURI, mw.code(), time.Since(start), mw.written)
+			}()
+			w = mw
+		}
+
+		if l.CORS != nil && l.CORS.handle(w, r) {
+			return
+		}
+
+		c, ok := r.Context().Value(connContextKey).(*Conn)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if c.raw {
+			l.FallbackHandler.ServeHTTP(w, r)
+			return
+		}
+
+		// The next packet of KeepAlive waits for the response.
+		atomic.AddInt32(&c.active, 1)
+		defer atomic.AddInt32(&c.active, -1)
+
+		env, accepted := c.request()
+		ctx := context.WithValue(r.Context(), varsContextKey, env)
+		ctx = context.WithValue(ctx, acceptedContextKey, accepted)
+		if l.HandlerTimeout > 0 {
+			deadline := accepted.Add(l.HandlerTimeout)
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+			ctx = context.WithValue(ctx, deadlineContextKey, deadline)
+		}
+		if id := l.requestID(env); id != "" {
+			ctx = context.WithValue(ctx, requestIDContextKey, id)
+			if l.EchoRequestID {
+				w.Header().Set(headerName(l.requestIDVar()), id)
+			}
+		}
+		r = r.WithContext(ctx)
+		if addr := remoteAddr(env); addr != "" {
+			r.RemoteAddr = addr
+		}
+		if scheme := l.scheme(env); scheme != "" {
+			u := *r.URL
+			u.Scheme = scheme
+			r.URL = &u
+			if scheme == "https" && r.TLS == nil {
+				r.TLS = tlsState(env)
+			}
+		}
+		if l.ResponseHook != nil || l.StatusHook != nil {
+			hw := &hookWriter{ResponseWriter: w, env: env, l: l}
+			// The handler may return without writing anything.
+			defer hw.callHook(http.StatusOK)
+			w = hw
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// hookWriter calls the hooks before the header is written.
+type hookWriter struct {
+	http.ResponseWriter
+	env    map[string][]string
+	l      *Listener
+	called bool
+}
+
+func (w *hookWriter) callHook(code int) {
+	if w.called {
+		return
+	}
+	w.called = true
+	if w.l.ResponseHook != nil {
+		w.l.ResponseHook(w.env, w.Header())
+	}
+	if w.l.StatusHook != nil {
+		w.l.StatusHook(code, w.Header())
+	}
+}
+
+func (w *hookWriter) WriteHeader(code int) {
+	// Informational responses are not the response header.
+	if code >= 200 || code == http.StatusSwitchingProtocols {
+		w.callHook(code)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *hookWriter) Write(b []byte) (int, error) {
+	w.callHook(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *hookWriter) Flush() {
+	w.callHook(http.StatusOK)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap is used by http.ResponseController.
+func (w *hookWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// remoteAddr returns the address of the client in the form of
+// net.JoinHostPort, or only the address if REMOTE_PORT is not known.
+func remoteAddr(env map[string][]string) string {
+	if !hasVar(env, "REMOTE_ADDR") {
+		return ""
+	}
+	addr := env["REMOTE_ADDR"][0]
+	if !hasVar(env, "REMOTE_PORT") {
+		return addr
+	}
+	return net.JoinHostPort(addr, env["REMOTE_PORT"][0])
+}
+
+// metricsWriter records the status and the size of the response for
+// Metrics.
+type metricsWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *metricsWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *metricsWriter) WriteHeader(code int) {
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *metricsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap is used by http.ResponseController.
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (l *Listener) requestIDVar() string {
+	if l.RequestIDVar != "" {
+		return l.RequestIDVar
+	}
+	return "HTTP_X_REQUEST_ID"
+}
+
+func (l *Listener) requestID(env map[string][]string) string {
+	if v, ok := env[l.requestIDVar()]; ok && v[0] != "" {
+		return v[0]
+	}
+	if !l.GenerateRequestID {
+		return ""
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// RequestID returns the request ID attached by Handler.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// Vars returns all of the uwsgi vars of the request, including the ones which
+// are not passed as headers, e.g. DOCUMENT_ROOT or UWSGI_APPID. This requires
+// Handler or ConnContext. The returned map must not be modified.
+func Vars(r *http.Request) map[string][]string {
+	if env, ok := r.Context().Value(varsContextKey).(map[string][]string); ok {
+		return env
+	}
+	if c, ok := r.Context().Value(connContextKey).(*Conn); ok {
+		env, _ := c.request()
+		return env
+	}
+	return nil
+}
+
+// ScriptName returns SCRIPT_NAME of the request, the mount point of the
+// application, without the trailing slash. This requires Handler or
+// ConnContext.
+func ScriptName(r *http.Request) string {
+	return strings.TrimSuffix(firstVar(Vars(r), "SCRIPT_NAME"), "/")
+}
+
+// Modifiers returns modifier1 and modifier2 of the uwsgi packet of the
+// request, e.g. to branch on them when AllowedModifiers accepts several. ok
+// is false for the request which didn't come in a uwsgi packet, such as the
+// raw HTTP of FallbackHandler. This requires Handler or ConnContext.
+func Modifiers(r *http.Request) (modifier1, modifier2 uint8, ok bool) {
+	c, _ := r.Context().Value(connContextKey).(*Conn)
+	if c == nil || c.raw {
+		return 0, 0, false
+	}
+	c.envMu.RLock()
+	defer c.envMu.RUnlock()
+	return c.modifier1, c.modifier2, c.env != nil
+}
+
+// AcceptedAt returns the time the connection of the request was accepted,
+// attached by Handler.
+func AcceptedAt(ctx context.Context) time.Time {
+	t, _ := ctx.Value(acceptedContextKey).(time.Time)
+	return t
+}
+
+// Deadline returns the deadline of the request by Listener.HandlerTimeout,
+// attached by Handler. ok is false if HandlerTimeout is not set.
+func Deadline(ctx context.Context) (deadline time.Time, ok bool) {
+	deadline, ok = ctx.Value(deadlineContextKey).(time.Time)
+	return
+}
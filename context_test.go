@@ -0,0 +1,254 @@
+package uwsgi
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// doRequest send the uwsgi packet and returns the response.
+func doRequest(t *testing.T, addr string, m map[string]string, body string) *http.Response {
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() { fd.Close() })
+	writePacket(fd, m)
+	fd.Write([]byte(body))
+
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	return res
+}
+
+func TestRequestID(t *testing.T) {
+	var got string
+	ul := &Listener{GenerateRequestID: true, EchoRequestID: true}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = RequestID(r.Context())
+	})))
+
+	m := map[string]string{
+		"REQUEST_METHOD":    "GET",
+		"REQUEST_URI":       "/",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"HTTP_HOST":         "localhost",
+		"HTTP_X_REQUEST_ID": "abc123",
+	}
+	res := doRequest(t, addr, m, "")
+	res.Body.Close()
+	if got != "abc123" {
+		t.Errorf("Unexpected request ID; got %q; expected %q", got, "abc123")
+	}
+	if echo := res.Header.Get("X-Request-Id"); echo != "abc123" {
+		t.Errorf("Unexpected echoed request ID; got %q; expected %q", echo, "abc123")
+	}
+
+	delete(m, "HTTP_X_REQUEST_ID")
+	res = doRequest(t, addr, m, "")
+	res.Body.Close()
+	if len(got) != 32 {
+		t.Errorf("Unexpected generated request ID; got %q", got)
+	}
+	if echo := res.Header.Get("X-Request-Id"); echo != got {
+		t.Errorf("Unexpected echoed request ID; got %q; expected %q", echo, got)
+	}
+}
+
+func TestResponseHook(t *testing.T) {
+	ul := &Listener{ResponseHook: func(env map[string][]string, h http.Header) {
+		if v, ok := env["UWSGI_ROUTE"]; ok {
+			h.Set("X-Route", v[0])
+		}
+	}}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"UWSGI_ROUTE":     "api",
+	}, "")
+	res.Body.Close()
+	if got := res.Header.Get("X-Route"); got != "api" {
+		t.Errorf("Unexpected X-Route; got %q; expected %q", got, "api")
+	}
+}
+
+func TestStatusHook(t *testing.T) {
+	ul := &Listener{StatusHook: func(status int, h http.Header) {
+		if status == http.StatusNotFound {
+			h.Set("X-Accel-Redirect", "/errors/404.html")
+		}
+	}}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+		}
+	})))
+
+	m := map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/missing",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	}
+	res := doRequest(t, addr, m, "")
+	res.Body.Close()
+	if got := res.Header.Get("X-Accel-Redirect"); got != "/errors/404.html" {
+		t.Errorf("Unexpected X-Accel-Redirect for 404; got %q", got)
+	}
+
+	m["REQUEST_URI"] = "/"
+	res = doRequest(t, addr, m, "")
+	res.Body.Close()
+	if got := res.Header.Get("X-Accel-Redirect"); got != "" {
+		t.Errorf("Unexpected X-Accel-Redirect for 200; got %q", got)
+	}
+}
+
+func TestVars(t *testing.T) {
+	var got map[string][]string
+	ul := &Listener{}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = Vars(r)
+	})))
+
+	m := map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"DOCUMENT_ROOT":   "/var/www",
+		"UWSGI_APPID":     "app1",
+	}
+	res := doRequest(t, addr, m, "")
+	res.Body.Close()
+	for _, k := range []string{"DOCUMENT_ROOT", "UWSGI_APPID"} {
+		if v := got[k]; len(v) != 1 || v[0] != m[k] {
+			t.Errorf("Unexpected %s; got %q; expected %q", k, v, m[k])
+		}
+	}
+
+	if env := Vars(httptest.NewRequest("GET", "/", nil)); env != nil {
+		t.Errorf("Unexpected vars without uwsgi; got %v", env)
+	}
+}
+
+func TestModifiers(t *testing.T) {
+	type mods struct {
+		modifier1, modifier2 uint8
+		ok                   bool
+	}
+	got := make(chan mods, 1)
+	ul := &Listener{AllowedModifiers: []uint8{ModifierHTTP, 5}}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m1, m2, ok := Modifiers(r)
+		got <- mods{m1, m2, ok}
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	WritePacket(fd, 5, 3, map[string][]string{
+		"REQUEST_METHOD":  {"GET"},
+		"REQUEST_URI":     {"/"},
+		"SERVER_PROTOCOL": {"HTTP/1.1"},
+		"HTTP_HOST":       {"localhost"},
+	})
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	res.Body.Close()
+	if m := <-got; m != (mods{5, 3, true}) {
+		t.Errorf("Unexpected modifiers; got %v; expected %v", m, mods{5, 3, true})
+	}
+
+	if _, _, ok := Modifiers(httptest.NewRequest("GET", "/", nil)); ok {
+		t.Error("Unexpected modifiers without uwsgi")
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	var got string
+	ul := &Listener{}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.RemoteAddr
+	})))
+
+	tests := []struct {
+		addr, port string
+		expected   string
+	}{
+		{"192.0.2.1", "54321", "192.0.2.1:54321"},
+		{"2001:db8::1", "54321", "[2001:db8::1]:54321"},
+		{"192.0.2.1", "", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		m := map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"REQUEST_URI":     "/",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+			"REMOTE_ADDR":     test.addr,
+		}
+		if test.port != "" {
+			m["REMOTE_PORT"] = test.port
+		}
+		res := doRequest(t, addr, m, "")
+		res.Body.Close()
+		if got != test.expected {
+			t.Errorf("Unexpected RemoteAddr; got %q; expected %q", got, test.expected)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	var accepted, deadline, ctxDeadline time.Time
+	var ok bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted = AcceptedAt(r.Context())
+		deadline, ok = Deadline(r.Context())
+		ctxDeadline, _ = r.Context().Deadline()
+	})
+	ul := &Listener{HandlerTimeout: 3 * time.Second}
+	addr := startListener(t, ul, ul.Handler(handler))
+
+	before := time.Now()
+	m := map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	}
+	res := doRequest(t, addr, m, "")
+	res.Body.Close()
+
+	if accepted.Before(before) || time.Since(accepted) > 5*time.Second {
+		t.Errorf("Unexpected accepted time; got %v", accepted)
+	}
+	if !ok || !deadline.Equal(accepted.Add(3*time.Second)) {
+		t.Errorf("Unexpected deadline; got %v %v; expected %v", deadline, ok, accepted.Add(3*time.Second))
+	}
+	if !ctxDeadline.Equal(deadline) {
+		t.Errorf("Unexpected deadline of the context; got %v; expected %v", ctxDeadline, deadline)
+	}
+
+	ul = &Listener{}
+	res = doRequest(t, startListener(t, ul, ul.Handler(handler)), m, "")
+	res.Body.Close()
+	if ok {
+		t.Errorf("Unexpected deadline without HandlerTimeout; got %v", deadline)
+	}
+}
@@ -0,0 +1,71 @@
+package uwsgi
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS is the configuration of CORS handling.
+type CORS struct {
+	// AllowedOrigins is the list of allowed origins. "*" allows any origin.
+	AllowedOrigins []string
+
+	// AllowedMethods is the list of methods allowed by preflight. GET, HEAD
+	// and POST are allowed if empty.
+	AllowedMethods []string
+
+	// AllowedHeaders is the list of request headers allowed by preflight.
+	AllowedHeaders []string
+
+	// MaxAge is the time the preflight result can be cached.
+	MaxAge time.Duration
+}
+
+func (c *CORS) allowOrigin(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// handle set CORS headers, and answer preflight. It returns true if the
+// request is answered.
+func (c *CORS) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if !c.allowOrigin(origin) {
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if !preflight {
+		return false
+	}
+
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{"GET", "HEAD", "POST"}
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(c.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,59 @@
+package uwsgi
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	called := false
+	ul := &Listener{CORS: &CORS{
+		AllowedOrigins: []string{"https://example.com"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Content-Type", "X-Token"},
+		MaxAge:         time.Hour,
+	}}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})))
+
+	m := map[string]string{
+		"REQUEST_METHOD":                     "OPTIONS",
+		"REQUEST_URI":                        "/api",
+		"SERVER_PROTOCOL":                    "HTTP/1.1",
+		"HTTP_HOST":                          "localhost",
+		"HTTP_ORIGIN":                        "https://example.com",
+		"HTTP_ACCESS_CONTROL_REQUEST_METHOD": "PUT",
+	}
+	res := doRequest(t, addr, m, "")
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("Unexpected status; got %d; expected %d", res.StatusCode, http.StatusNoContent)
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "https://example.com",
+		"Access-Control-Allow-Methods": "GET, PUT",
+		"Access-Control-Allow-Headers": "Content-Type, X-Token",
+		"Access-Control-Max-Age":       "3600",
+	}
+	for k, v := range expected {
+		if got := res.Header.Get(k); got != v {
+			t.Errorf("Unexpected %s; got %q; expected %q", k, got, v)
+		}
+	}
+	if called {
+		t.Error("Handler should not be called for preflight")
+	}
+
+	m["HTTP_ORIGIN"] = "https://evil.example"
+	res = doRequest(t, addr, m, "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Unexpected status for disallowed origin; got %d; expected %d", res.StatusCode, http.StatusForbidden)
+	}
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Unexpected Access-Control-Allow-Origin for disallowed origin; got %q", got)
+	}
+}
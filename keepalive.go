@@ -0,0 +1,131 @@
+package uwsgi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// keepAlive reports whether the next packet may follow the body of the
+// current request, by Listener.KeepAlive.
+func (c *Conn) keepAlive() bool {
+	return c.l.KeepAlive && !c.raw && !c.tunneled && !c.last
+}
+
+// next read the packet of the next request and prepare it, for Read. The
+// packet cut by the deadline, e.g. when http.Server aborts its background
+// read, is kept and its read resumes in the next call. io.EOF before the
+// packet means the front-end closed the connection between the requests.
+//
+// The packet pipelined while Handler is running is read by the background
+// read of http.Server. It is held until the server aborts the read after
+// the response, so the request is prepared by the next Read of the server.
+func (c *Conn) next() error {
+	order := c.l.ByteOrder
+	if order == nil {
+		order = binary.LittleEndian
+	}
+	c.clearReadRequestDeadline()
+	for {
+		need := 4
+		if len(c.pkt) >= 4 {
+			if err := c.checkNext(c.pkt, order); err != nil {
+				c.fail(err)
+				return err
+			}
+			need += int(order.Uint16(c.pkt[1:3]))
+			if len(c.pkt) == need {
+				break
+			}
+		}
+		if cap(c.pkt) < need {
+			pkt := make([]byte, len(c.pkt), need)
+			copy(pkt, c.pkt)
+			c.pkt = pkt
+		}
+		n, err := c.Conn.Read(c.pkt[len(c.pkt):need])
+		if n > 0 && len(c.pkt) == 0 {
+			c.pktStart = time.Now()
+		}
+		c.pkt = c.pkt[:len(c.pkt)+n]
+		// The error after some bytes is returned by the next read again.
+		if err == nil || n > 0 {
+			continue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return err
+		}
+		if err == io.EOF && len(c.pkt) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		c.fail(err)
+		return err
+	}
+	if atomic.LoadInt32(&c.active) > 0 {
+		return c.holdNext()
+	}
+	pkt := c.pkt
+	c.pkt = nil
+
+	env, err := Decoder{LengthSize: c.l.LengthSize, ByteOrder: order}.Decode(pkt[4:])
+	if err != nil {
+		c.fail(err)
+		return err
+	}
+
+	// The previous request is done.
+	if m, ok := c.l.Metrics.(RequestMetrics); ok {
+		c.observe(m)
+	}
+	atomic.StoreInt64(&c.bodyRead, 0)
+	atomic.StoreInt64(&c.written, 0)
+	c.releasePeer()
+	c.hdrdone = false
+	c.chunked = nil
+	c.prepare(env, int64(len(pkt)), c.pktStart, pkt[0], pkt[3])
+	return nil
+}
+
+// holdNext wait until the read deadline passes, or the connection is closed,
+// while the next packet is kept.
+func (c *Conn) holdNext() error {
+	for {
+		c.deadlineMu.Lock()
+		deadline := c.readDeadline
+		c.deadlineMu.Unlock()
+		if !deadline.IsZero() && !deadline.After(time.Now()) {
+			return os.ErrDeadlineExceeded
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case <-c.closed:
+			return net.ErrClosed
+		case <-timeout:
+		case <-c.deadlinech:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// checkNext check the header of the next packet. Only the HTTP requests
+// follow on a KeepAlive connection.
+func (c *Conn) checkNext(head []byte, order binary.ByteOrder) error {
+	if head[0] != ModifierHTTP {
+		return fmt.Errorf("Invalid uwsgi request; modifier1 %d is not allowed on a kept-alive connection", head[0])
+	}
+	if size := order.Uint16(head[1:3]); c.l.MaxEnvSize > 0 && size > c.l.MaxEnvSize {
+		return fmt.Errorf("Invalid uwsgi request; datasize %d exceeds MaxEnvSize %d", size, c.l.MaxEnvSize)
+	}
+	return nil
+}
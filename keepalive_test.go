@@ -0,0 +1,184 @@
+package uwsgi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func keepAliveVars(method, uri string, body string) map[string]string {
+	m := map[string]string{
+		"REQUEST_METHOD":  method,
+		"REQUEST_URI":     uri,
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	}
+	if body != "" {
+		m["CONTENT_LENGTH"] = strconv.Itoa(len(body))
+	}
+	return m
+}
+
+func readKeepAliveResponse(t *testing.T, br *bufio.Reader) (*http.Response, string) {
+	t.Helper()
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	metrics := &testMetrics{}
+	ul := &Listener{KeepAlive: true, Metrics: metrics}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(r.Method + " " + r.URL.Path + " " + string(body) + " " + Vars(r)["REQUEST_URI"][0]))
+	})))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	fd.SetDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReader(fd)
+
+	requests := []struct {
+		method, uri, body string
+	}{
+		{"GET", "/first", ""},
+		{"POST", "/second", "hello"},
+		{"GET", "/third", ""},
+	}
+	for _, req := range requests {
+		writePacket(fd, keepAliveVars(req.method, req.uri, req.body))
+		fd.Write([]byte(req.body))
+		res, body := readKeepAliveResponse(t, br)
+		expected := req.method + " " + req.uri + " " + req.body + " " + req.uri
+		if body != expected || res.Close {
+			t.Errorf("Unexpected response; got %q (close %v); expected %q", body, res.Close, expected)
+		}
+	}
+
+	// The next packet arrives partly while the handler is running.
+	var next bytes.Buffer
+	writePacket(&next, keepAliveVars("GET", "/after", ""))
+	writePacket(fd, keepAliveVars("GET", "/slow", ""))
+	time.Sleep(50 * time.Millisecond)
+	fd.Write(next.Bytes()[:10])
+	time.Sleep(300 * time.Millisecond)
+	fd.Write(next.Bytes()[10:])
+	for _, uri := range []string{"/slow", "/after"} {
+		if _, body := readKeepAliveResponse(t, br); body != "GET "+uri+"  "+uri {
+			t.Errorf("Unexpected response; got %q; expected the one of %s", body, uri)
+		}
+	}
+
+	fd.Close()
+	observations := metrics.waitObservations(t, 5)
+	for i, uri := range []string{"/first", "/second", "/third", "/slow", "/after"} {
+		if observations[i].uri != uri {
+			t.Errorf("Unexpected observation %d; got %q; expected %q", i, observations[i].uri, uri)
+		}
+	}
+}
+
+func TestKeepAliveChunked(t *testing.T) {
+	ul := &Listener{KeepAlive: true}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	fd.SetDeadline(time.Now().Add(10 * time.Second))
+	m := keepAliveVars("POST", "/", "")
+	m["HTTP_TRANSFER_ENCODING"] = "chunked"
+	m["HTTP_CONNECTION"] = "keep-alive"
+	writePacket(fd, m)
+	fd.Write([]byte("5\r\nhello\r\n0\r\n\r\n"))
+
+	br := bufio.NewReader(fd)
+	res, body := readKeepAliveResponse(t, br)
+	if body != "hello" || !res.Close {
+		t.Errorf("Unexpected response; got %q (close %v); expected %q and close", body, res.Close, "hello")
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("Connection should be closed after the chunked request; got %v", err)
+	}
+}
+
+func TestKeepAliveModifier(t *testing.T) {
+	ul := &Listener{KeepAlive: true}
+	addr := startListener(t, ul, http.NotFoundHandler())
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	fd.SetDeadline(time.Now().Add(10 * time.Second))
+	writePacket(fd, keepAliveVars("GET", "/", ""))
+	br := bufio.NewReader(fd)
+	if res, _ := readKeepAliveResponse(t, br); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Unexpected status; got %d", res.StatusCode)
+	}
+
+	// Only HTTP requests follow on the connection.
+	fd.Write([]byte{ModifierPing, 0, 0, 0})
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("Connection should be closed for the other modifier; got %v", err)
+	}
+}
+
+func TestKeepAlivePipelined(t *testing.T) {
+	ul := &Listener{KeepAlive: true}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			// The next packet arrives meanwhile.
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, modifier2, _ := Modifiers(r)
+		w.Write([]byte(r.URL.Path + " " + strconv.Itoa(int(modifier2))))
+	})))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	fd.SetDeadline(time.Now().Add(10 * time.Second))
+	var pkts bytes.Buffer
+	for i, uri := range []string{"/slow", "/next"} {
+		vars := make(map[string][]string)
+		for k, v := range keepAliveVars("GET", uri, "") {
+			vars[k] = []string{v}
+		}
+		WritePacket(&pkts, ModifierHTTP, uint8(i), vars)
+	}
+	fd.Write(pkts.Bytes())
+
+	br := bufio.NewReader(fd)
+	for i, uri := range []string{"/slow", "/next"} {
+		expected := uri + " " + strconv.Itoa(i)
+		if _, body := readKeepAliveResponse(t, br); body != expected {
+			t.Errorf("Unexpected response; got %q; expected %q", body, expected)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package uwsgi
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives the metrics of Listener.
+type Metrics interface {
+	// ObserveAdmission is called when a connection is admitted by
+	// MaxConns, with the number of connections still waiting, the number
+	// of connections in flight including this one, and the time this one
+	// waited.
+	ObserveAdmission(queued, inflight int, waited time.Duration)
+
+	// OnRequestComplete is called by Listener.Handler after the handler
+	// returned, with the status and the number of body bytes of the
+	// response. It is the view of the application: the duration is the
+	// one of the handler, and the requests served without Handler are
+	// not reported. See RequestMetrics for the view of the connection.
+	OnRequestComplete(method, uri string, status int, duration time.Duration, bytesOut int64)
+}
+
+// RequestMetrics observes the sizes and the latency of the requests on the
+// wire. The Metrics of Listener which implements it too gets both hooks for
+// the same request: OnRequestComplete when the handler returns, and then
+// ObserveRequest when the request is done on the connection, i.e. when the
+// connection is closed or the next packet of KeepAlive is read. Count the
+// requests by only one of them. ObserveRequest is called with or without
+// Handler; the time is since the connection was accepted, or since the
+// packet arrived for KeepAlive, the bytes of the request are the uwsgi
+// packet and the body read, and the bytes of the response are all written
+// to the connection including the status line and the headers.
+//
+// Passenger.Metrics is called after each response is relayed, with the
+// bytes sent to and read from the backend.
+type RequestMetrics interface {
+	ObserveRequest(method, uri string, dur time.Duration, reqBytes, respBytes int64)
+}
+
+// exchangeStats are the bytes of an exchange of Passenger with the backend.
+// body is stored by the goroutine which sends the body.
+type exchangeStats struct {
+	packet int64
+	body   int64
+	resp   int64
+}
+
+// observe report the request of the connection to RequestMetrics. The
+// connection which was not parsed, or not served by the HTTP server, is not
+// reported.
+func (c *Conn) observe(m RequestMetrics) {
+	select {
+	case <-c.readych:
+	default:
+		return
+	}
+	if c.raw || c.tunneled {
+		return
+	}
+	c.envMu.RLock()
+	env, accepted, size := c.env, c.accepted, c.envBytes
+	c.envMu.RUnlock()
+	if env == nil {
+		return
+	}
+	m.ObserveRequest(firstVar(env, "REQUEST_METHOD"), firstVar(env, "REQUEST_URI"),
+		time.Since(accepted), size+atomic.LoadInt64(&c.bodyRead), atomic.LoadInt64(&c.written))
+}
+
+// States of Conn.slot.
+const (
+	slotNone int32 = iota
+	slotAdmitted
+	slotReleased
+)
+
+// admit wait for a slot of MaxConns. It returns false if the connection is
+// rejected.
+func (l *Listener) admit(c *Conn) bool {
+	if l.MaxConns <= 0 {
+		return true
+	}
+	l.limit.Do(func() {
+		l.sem = make(chan struct{}, l.MaxConns)
+	})
+
+	start := time.Now()
+	select {
+	case l.sem <- struct{}{}:
+	default:
+		if l.RejectOverLimit {
+			c.reject(http.StatusServiceUnavailable, errors.New("Too many connections"))
+			return false
+		}
+		atomic.AddInt64(&l.queued, 1)
+		err := c.waitSlot()
+		atomic.AddInt64(&l.queued, -1)
+		if err != nil {
+			c.fail(err)
+			return false
+		}
+	}
+	waited := time.Since(start)
+	if !atomic.CompareAndSwapInt32(&c.slot, slotNone, slotAdmitted) {
+		// Closed while waiting.
+		<-l.sem
+		c.fail(io.EOF)
+		return false
+	}
+
+	inflight := atomic.AddInt64(&l.inflight, 1)
+	atomic.AddInt64(&l.waited, int64(waited))
+	if l.Metrics != nil {
+		l.Metrics.ObserveAdmission(int(atomic.LoadInt64(&l.queued)), int(inflight), waited)
+	}
+	return true
+}
+
+var errRetry = errors.New("retry")
+
+// waitSlot wait for a slot of MaxConns until the connection is closed or the
+// read deadline of the server passes.
+func (c *Conn) waitSlot() error {
+	for {
+		c.deadlineMu.Lock()
+		deadline := c.readDeadline
+		c.deadlineMu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		var err error
+		select {
+		case c.l.sem <- struct{}{}:
+		case <-c.closed:
+			err = io.EOF
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-c.deadlinech:
+			// Wait again with the new deadline.
+			err = errRetry
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != errRetry {
+			return err
+		}
+	}
+}
+
+// admitPeer count the connection for REMOTE_ADDR, the client of the
+// front-end. It returns false if the client has MaxConnsPerIP connections
+// already.
+func (l *Listener) admitPeer(c *Conn) bool {
+	if l.MaxConnsPerIP <= 0 || !hasVar(c.env, "REMOTE_ADDR") {
+		return true
+	}
+	ip := c.env["REMOTE_ADDR"][0]
+
+	l.perIPMu.Lock()
+	defer l.perIPMu.Unlock()
+	if atomic.LoadInt32(&c.slot) == slotReleased {
+		// Closed already.
+		return true
+	}
+	if l.perIP[ip] >= l.MaxConnsPerIP {
+		return false
+	}
+	if l.perIP == nil {
+		l.perIP = make(map[string]int)
+	}
+	l.perIP[ip]++
+	c.peerIP = ip
+	return true
+}
+
+// release the slot of MaxConns and MaxConnsPerIP, and the tracking of
+// Shutdown.
+func (c *Conn) release() {
+	c.l.untrack(c)
+	if atomic.SwapInt32(&c.slot, slotReleased) == slotAdmitted {
+		atomic.AddInt64(&c.l.inflight, -1)
+		<-c.l.sem
+	}
+
+	c.releasePeer()
+}
+
+// releasePeer release the count of MaxConnsPerIP.
+func (c *Conn) releasePeer() {
+	if c.l.MaxConnsPerIP <= 0 {
+		return
+	}
+	c.l.perIPMu.Lock()
+	defer c.l.perIPMu.Unlock()
+	if c.peerIP != "" {
+		if c.l.perIP[c.peerIP]--; c.l.perIP[c.peerIP] == 0 {
+			delete(c.l.perIP, c.peerIP)
+		}
+		c.peerIP = ""
+	}
+}
+
+// InFlight returns the number of connections admitted by MaxConns and not
+// closed yet.
+func (l *Listener) InFlight() int {
+	return int(atomic.LoadInt64(&l.inflight))
+}
+
+// Queued returns the number of connections waiting for a slot of MaxConns.
+func (l *Listener) Queued() int {
+	return int(atomic.LoadInt64(&l.queued))
+}
+
+// Waited returns the total time the connections waited for slots of
+// MaxConns.
+func (l *Listener) Waited() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.waited))
+}
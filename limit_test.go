@@ -0,0 +1,408 @@
+package uwsgi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type admission struct {
+	queued, inflight int
+	waited           time.Duration
+}
+
+type completion struct {
+	method, uri string
+	status      int
+	duration    time.Duration
+	bytesOut    int64
+}
+
+type observation struct {
+	method, uri         string
+	dur                 time.Duration
+	reqBytes, respBytes int64
+}
+
+type testMetrics struct {
+	mu           sync.Mutex
+	admissions   []admission
+	completions  []completion
+	observations []observation
+}
+
+func (m *testMetrics) ObserveRequest(method, uri string, dur time.Duration, reqBytes, respBytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observations = append(m.observations, observation{method, uri, dur, reqBytes, respBytes})
+}
+
+// waitObservations wait for n observations, which are made asynchronously by
+// the close of the connections.
+func (m *testMetrics) waitObservations(t *testing.T, n int) []observation {
+	for i := 0; i < 500; i++ {
+		m.mu.Lock()
+		got := m.observations
+		m.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Unexpected number of observations; expected %d", n)
+	return nil
+}
+
+func (m *testMetrics) ObserveAdmission(queued, inflight int, waited time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.admissions = append(m.admissions, admission{queued, inflight, waited})
+}
+
+func (m *testMetrics) OnRequestComplete(method, uri string, status int, duration time.Duration, bytesOut int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.completions = append(m.completions, completion{method, uri, status, duration, bytesOut})
+}
+
+var testVars = map[string]string{
+	"REQUEST_METHOD":  "GET",
+	"REQUEST_URI":     "/",
+	"SERVER_PROTOCOL": "HTTP/1.1",
+	"HTTP_HOST":       "localhost",
+}
+
+func TestMaxConnsQueue(t *testing.T) {
+	metrics := &testMetrics{}
+	release := make(chan struct{})
+	ul := &Listener{MaxConns: 1, Metrics: metrics}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	var fds []net.Conn
+	for n := 0; n < 3; n++ {
+		fd, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		defer fd.Close()
+		writePacket(fd, testVars)
+		fds = append(fds, fd)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for ul.Queued() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := ul.Queued(); got != 2 {
+		t.Fatalf("Unexpected queue depth; got %d; expected %d", got, 2)
+	}
+	if got := ul.InFlight(); got != 1 {
+		t.Fatalf("Unexpected in-flight connections; got %d; expected %d", got, 1)
+	}
+
+	close(release)
+	for _, fd := range fds {
+		res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+		if err != nil {
+			t.Fatalf("read response error: %v", err)
+		}
+		res.Body.Close()
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if len(metrics.admissions) != 3 {
+		t.Fatalf("Unexpected number of admissions; got %d; expected %d", len(metrics.admissions), 3)
+	}
+	if a := metrics.admissions[1]; a.queued != 1 || a.inflight != 1 || a.waited <= 0 {
+		t.Errorf("Unexpected second admission; got %+v", a)
+	}
+	if ul.Waited() <= 0 {
+		t.Errorf("Unexpected total waited duration; got %v", ul.Waited())
+	}
+}
+
+func TestMaxConnsQueueClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	ul := &Listener{Listener: l, MaxConns: 1}
+	defer ul.Close()
+
+	accept := func() net.Conn {
+		fd, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		t.Cleanup(func() { fd.Close() })
+		writePacket(fd, testVars)
+		c, err := ul.Accept()
+		if err != nil {
+			t.Fatalf("accept error: %v", err)
+		}
+		return c
+	}
+	read := func(c net.Conn) chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := c.Read(make([]byte, 1))
+			done <- err
+		}()
+		return done
+	}
+
+	first := accept()
+	if _, err := first.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+
+	// The queued connection is closed, and the reading stops.
+	closed := accept()
+	closedRead := read(closed)
+	// The queued connection gives up at the read deadline.
+	timedOut := accept()
+	timedOutRead := read(timedOut)
+	deadline := time.Now().Add(time.Second)
+	for ul.Queued() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	closed.Close()
+	timedOut.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+	for name, done := range map[string]chan error{"closed": closedRead, "timed out": timedOutRead} {
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("Expected read error of %s connection", name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Read of %s connection hung", name)
+		}
+	}
+	if got := ul.Queued(); got != 0 {
+		t.Errorf("Unexpected queue depth; got %d; expected %d", got, 0)
+	}
+
+	// The slot is still available after the queued ones gave up.
+	first.Close()
+	next := accept()
+	defer next.Close()
+	select {
+	case err := <-read(next):
+		if err != nil {
+			t.Errorf("read error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read of next connection hung")
+	}
+}
+
+func TestMaxConnsReject(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ul := &Listener{MaxConns: 1, RejectOverLimit: true}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, testVars)
+	deadline := time.Now().Add(time.Second)
+	for ul.InFlight() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res := doRequest(t, addr, testVars, "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status; got %d; expected %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	started := make(chan bool, 3)
+	release := make(chan struct{})
+	ul := &Listener{MaxConnsPerIP: 1}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	}))
+
+	vars := func(ip string) map[string]string {
+		m := map[string]string{"REMOTE_ADDR": ip}
+		for k, v := range testVars {
+			m[k] = v
+		}
+		return m
+	}
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, vars("192.0.2.1"))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The first request is not served")
+	}
+
+	res := doRequest(t, addr, vars("192.0.2.1"), "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status for the same IP; got %d; expected %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	other, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer other.Close()
+	writePacket(other, vars("192.0.2.2"))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request from another IP is not served")
+	}
+	close(release)
+	for _, c := range []net.Conn{fd, other} {
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("read response error: %v", err)
+		}
+		res.Body.Close()
+		c.Close()
+	}
+
+	// The count is decremented on close.
+	deadline := time.Now().Add(time.Second)
+	for {
+		ul.perIPMu.Lock()
+		n := len(ul.perIP)
+		ul.perIPMu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Connections are not released; got %d IPs", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	metrics := &testMetrics{}
+	ul := &Listener{Metrics: metrics}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})))
+
+	m := map[string]string{"REQUEST_URI": "/pot?x=1"}
+	for k, v := range testVars {
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	res := doRequest(t, addr, m, "")
+	res.Body.Close()
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if len(metrics.completions) != 1 {
+		t.Fatalf("Unexpected number of completions; got %d; expected %d", len(metrics.completions), 1)
+	}
+	c := metrics.completions[0]
+	if c.method != "GET" || c.uri != "/pot?x=1" || c.status != http.StatusTeapot || c.bytesOut != 15 {
+		t.Errorf("Unexpected completion; got %+v", c)
+	}
+	if c.duration < 50*time.Millisecond || c.duration > 5*time.Second {
+		t.Errorf("Unexpected duration; got %v", c.duration)
+	}
+}
+
+func TestObserveRequest(t *testing.T) {
+	metrics := &testMetrics{}
+	ul := &Listener{Metrics: metrics}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("short and stout"))
+	}))
+
+	m := map[string]string{"REQUEST_METHOD": "POST", "REQUEST_URI": "/pot", "CONTENT_LENGTH": "5"}
+	for k, v := range testVars {
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	var packet bytes.Buffer
+	writePacket(&packet, m)
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	fd.Write(packet.Bytes())
+	fd.Write([]byte("hello"))
+	fd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	dump, _ := ioutil.ReadAll(fd)
+
+	o := metrics.waitObservations(t, 1)[0]
+	if o.method != "POST" || o.uri != "/pot" {
+		t.Errorf("Unexpected request; got %q %q", o.method, o.uri)
+	}
+	if o.reqBytes != int64(packet.Len()+5) || o.respBytes != int64(len(dump)) {
+		t.Errorf("Unexpected bytes; got %d %d; expected %d %d", o.reqBytes, o.respBytes, packet.Len()+5, len(dump))
+	}
+	if o.dur <= 0 || o.dur > 5*time.Second {
+		t.Errorf("Unexpected duration; got %v", o.dur)
+	}
+}
+
+func TestPassengerObserveRequest(t *testing.T) {
+	const response = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	metrics := &testMetrics{}
+	p := Passenger{Net: "pipe", Addr: "backend", Metrics: metrics, Dial: func(network, addr string) (net.Conn, error) {
+		front, back := net.Pipe()
+		go func() {
+			defer back.Close()
+			if _, _, _, err := ReadPacket(back); err != nil {
+				return
+			}
+			var body [4]byte
+			io.ReadFull(back, body[:])
+			back.Write([]byte(response))
+		}()
+		return front, nil
+	}}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", "/pot?x=1", strings.NewReader("body")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status; got %d", w.Code)
+	}
+	o := metrics.waitObservations(t, 1)[0]
+	if o.method != "POST" || o.uri != "/pot?x=1" || o.respBytes != int64(len(response)) {
+		t.Errorf("Unexpected observation; got %+v", o)
+	}
+	if o.reqBytes <= 4+4 {
+		t.Errorf("Unexpected bytes of the request; got %d", o.reqBytes)
+	}
+}
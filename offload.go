@@ -0,0 +1,34 @@
+package uwsgi
+
+import (
+	"net/http"
+)
+
+// Headers to offload the response to the front-end.
+const (
+	// OffloadAccelRedirect is for nginx. The path is the URI of an
+	// internal location:
+	//
+	//	location /protected/ {
+	//		internal;
+	//		alias /var/www/files/;
+	//	}
+	OffloadAccelRedirect = "X-Accel-Redirect"
+
+	// OffloadSendfile is for uWSGI router, Apache and lighttpd. The path is
+	// the file path. uWSGI should be configured to collect the header:
+	//
+	//	collect-header = X-Sendfile X_SENDFILE
+	//	response-route-if-not = empty:${X_SENDFILE} static:${X_SENDFILE}
+	OffloadSendfile = "X-Sendfile"
+)
+
+// Offload write the response which asks the front-end to serve the file,
+// instead of writing the body. header is OffloadAccelRedirect or
+// OffloadSendfile depending on the front-end. The headers set to w before,
+// such as Content-Type, are sent with the response.
+func Offload(w http.ResponseWriter, header, path string) {
+	w.Header().Set(header, path)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,35 @@
+package uwsgi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestOffload(t *testing.T) {
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		Offload(w, OffloadAccelRedirect, "/protected/report.pdf")
+	}))
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/report",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	}, "")
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status; got %d; expected %d", res.StatusCode, http.StatusOK)
+	}
+	if got := res.Header.Get("X-Accel-Redirect"); got != "/protected/report.pdf" {
+		t.Errorf("Unexpected X-Accel-Redirect; got %q", got)
+	}
+	if got := res.Header.Get("Content-Type"); got != "application/pdf" {
+		t.Errorf("Unexpected Content-Type; got %q", got)
+	}
+	if res.ContentLength != 0 || len(body) != 0 {
+		t.Errorf("Unexpected body; got %q (Content-Length %d)", string(body), res.ContentLength)
+	}
+}
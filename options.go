@@ -0,0 +1,173 @@
+package uwsgi
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Option configures Listener. See NewListener.
+type Option func(*Listener)
+
+// DefaultHeaderTimeout is Listener.HeaderTimeout set by NewListener, so the
+// connections which never send the packet don't stay forever.
+const DefaultHeaderTimeout = 30 * time.Second
+
+// NewListener returns Listener which reads uwsgi packets from inner,
+// configured by opts. Unlike the struct literal, the Listener has the
+// defaults: DefaultHeaderTimeout. The options cover the settings; the hooks
+// such as ResponseHook and TunnelHandler are set to the fields of the
+// returned Listener before serving.
+//
+//	l, err := net.Listen("unix", "/path/to/socket")
+//	ul := uwsgi.NewListener(l, uwsgi.WithHeaderTimeout(5*time.Second))
+func NewListener(inner net.Listener, opts ...Option) *Listener {
+	l := &Listener{Listener: inner, HeaderTimeout: DefaultHeaderTimeout}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// WithHeaderTimeout sets Listener.HeaderTimeout. Zero disables
+// DefaultHeaderTimeout.
+func WithHeaderTimeout(d time.Duration) Option {
+	return func(l *Listener) { l.HeaderTimeout = d }
+}
+
+// WithHandlerTimeout sets Listener.HandlerTimeout.
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(l *Listener) { l.HandlerTimeout = d }
+}
+
+// WithRequestTimeout sets Listener.RequestTimeout.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(l *Listener) { l.RequestTimeout = d }
+}
+
+// WithHeaderMap sets Listener.HeaderMap.
+func WithHeaderMap(m map[string]string) Option {
+	return func(l *Listener) { l.HeaderMap = m }
+}
+
+// WithErrorLog sets Listener.ErrorLog.
+func WithErrorLog(logger *log.Logger) Option {
+	return func(l *Listener) { l.ErrorLog = logger }
+}
+
+// WithMaxHeaders sets Listener.MaxHeaders.
+func WithMaxHeaders(n int) Option {
+	return func(l *Listener) { l.MaxHeaders = n }
+}
+
+// WithMaxRequestBytes sets Listener.MaxRequestBytes.
+func WithMaxRequestBytes(n int64) Option {
+	return func(l *Listener) { l.MaxRequestBytes = n }
+}
+
+// WithMaxConns sets Listener.MaxConns and Listener.RejectOverLimit.
+func WithMaxConns(n int, reject bool) Option {
+	return func(l *Listener) {
+		l.MaxConns = n
+		l.RejectOverLimit = reject
+	}
+}
+
+// WithTrustedProxies sets Listener.TrustedProxies.
+func WithTrustedProxies(networks ...*net.IPNet) Option {
+	return func(l *Listener) { l.TrustedProxies = networks }
+}
+
+// WithSchemeVar sets Listener.SchemeVar.
+func WithSchemeVar(name string) Option {
+	return func(l *Listener) { l.SchemeVar = name }
+}
+
+// WithMetrics sets Listener.Metrics.
+func WithMetrics(m Metrics) Option {
+	return func(l *Listener) { l.Metrics = m }
+}
+
+// WithAllowedModifiers sets Listener.AllowedModifiers and
+// Listener.UnsupportedModifierAction.
+func WithAllowedModifiers(action ModifierAction, modifiers ...uint8) Option {
+	return func(l *Listener) {
+		l.AllowedModifiers = modifiers
+		l.UnsupportedModifierAction = action
+	}
+}
+
+// WithByteOrder sets Listener.ByteOrder.
+func WithByteOrder(order binary.ByteOrder) Option {
+	return func(l *Listener) { l.ByteOrder = order }
+}
+
+// WithOnError sets Listener.OnError.
+func WithOnError(f func(conn net.Conn, err error)) Option {
+	return func(l *Listener) { l.OnError = f }
+}
+
+// WithKeepAlive sets Listener.KeepAlive.
+func WithKeepAlive() Option {
+	return func(l *Listener) { l.KeepAlive = true }
+}
+
+// WithDefaultHost sets Listener.DefaultHost.
+func WithDefaultHost(host string) Option {
+	return func(l *Listener) { l.DefaultHost = host }
+}
+
+// WithFallbackHandler sets Listener.FallbackHandler.
+func WithFallbackHandler(h http.Handler) Option {
+	return func(l *Listener) { l.FallbackHandler = h }
+}
+
+// WithRequestID sets Listener.RequestIDVar, Listener.GenerateRequestID and
+// Listener.EchoRequestID.
+func WithRequestID(name string, generate, echo bool) Option {
+	return func(l *Listener) {
+		l.RequestIDVar = name
+		l.GenerateRequestID = generate
+		l.EchoRequestID = echo
+	}
+}
+
+// WithPeers sets Listener.AllowedPeers and Listener.DeniedPeers.
+func WithPeers(allowed, denied []*net.IPNet) Option {
+	return func(l *Listener) {
+		l.AllowedPeers = allowed
+		l.DeniedPeers = denied
+	}
+}
+
+// WithMaxConnsPerIP sets Listener.MaxConnsPerIP.
+func WithMaxConnsPerIP(n int) Option {
+	return func(l *Listener) { l.MaxConnsPerIP = n }
+}
+
+// WithCORS sets Listener.CORS.
+func WithCORS(c *CORS) Option {
+	return func(l *Listener) { l.CORS = c }
+}
+
+// WithInlineParse sets Listener.InlineParse.
+func WithInlineParse() Option {
+	return func(l *Listener) { l.InlineParse = true }
+}
+
+// WithStripScriptName sets Listener.StripScriptName.
+func WithStripScriptName() Option {
+	return func(l *Listener) { l.StripScriptName = true }
+}
+
+// WithMaxEnvSize sets Listener.MaxEnvSize.
+func WithMaxEnvSize(size uint16) Option {
+	return func(l *Listener) { l.MaxEnvSize = size }
+}
+
+// WithUnboundedBody sets Listener.UnboundedBody.
+func WithUnboundedBody() Option {
+	return func(l *Listener) { l.UnboundedBody = true }
+}
@@ -0,0 +1,86 @@
+package uwsgi
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+
+	logger := log.New(&bytes.Buffer{}, "", 0)
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	ul := NewListener(l,
+		WithHeaderTimeout(time.Second),
+		WithHandlerTimeout(2*time.Second),
+		WithHeaderMap(map[string]string{"UWSGI_APPID": "X-App-Id"}),
+		WithErrorLog(logger),
+		WithMaxHeaders(10),
+		WithMaxRequestBytes(1<<20),
+		WithMaxConns(5, true),
+		WithTrustedProxies(trusted),
+	)
+	if ul.Listener != l {
+		t.Error("Listener should wrap the inner listener")
+	}
+	if ul.HeaderTimeout != time.Second || ul.HandlerTimeout != 2*time.Second {
+		t.Errorf("Unexpected timeouts; got %v %v", ul.HeaderTimeout, ul.HandlerTimeout)
+	}
+	if ul.HeaderMap["UWSGI_APPID"] != "X-App-Id" || ul.ErrorLog != logger {
+		t.Error("Unexpected HeaderMap or ErrorLog")
+	}
+	if ul.MaxHeaders != 10 || ul.MaxRequestBytes != 1<<20 || ul.MaxConns != 5 || !ul.RejectOverLimit {
+		t.Errorf("Unexpected limits; got %d %d %d %v", ul.MaxHeaders, ul.MaxRequestBytes, ul.MaxConns, ul.RejectOverLimit)
+	}
+	if len(ul.TrustedProxies) != 1 || ul.TrustedProxies[0] != trusted {
+		t.Errorf("Unexpected TrustedProxies; got %v", ul.TrustedProxies)
+	}
+}
+
+func TestNewListenerDefaults(t *testing.T) {
+	ul := NewListener(nil)
+	if ul.HeaderTimeout != DefaultHeaderTimeout {
+		t.Errorf("Unexpected HeaderTimeout; got %v; expected %v", ul.HeaderTimeout, DefaultHeaderTimeout)
+	}
+	if ul = NewListener(nil, WithHeaderTimeout(0)); ul.HeaderTimeout != 0 {
+		t.Errorf("Unexpected HeaderTimeout; got %v; expected %v", ul.HeaderTimeout, 0)
+	}
+
+	fallback := http.NotFoundHandler()
+	_, denied, _ := net.ParseCIDR("192.0.2.0/24")
+	ul = NewListener(nil,
+		WithAllowedModifiers(ModifierRespond, ModifierHTTP, 5),
+		WithKeepAlive(),
+		WithDefaultHost("localhost"),
+		WithFallbackHandler(fallback),
+		WithRequestID("HTTP_X_TRACE_ID", true, true),
+		WithPeers(nil, []*net.IPNet{denied}),
+		WithMaxConnsPerIP(3),
+		WithInlineParse(),
+		WithUnboundedBody(),
+		WithSchemeVar("HTTP_X_SCHEME"),
+	)
+	if len(ul.AllowedModifiers) != 2 || ul.AllowedModifiers[1] != 5 || ul.UnsupportedModifierAction != ModifierRespond {
+		t.Errorf("Unexpected modifiers; got %v %v", ul.AllowedModifiers, ul.UnsupportedModifierAction)
+	}
+	if !ul.KeepAlive || ul.DefaultHost != "localhost" || ul.FallbackHandler == nil {
+		t.Errorf("Unexpected KeepAlive, DefaultHost or FallbackHandler; got %v %q %v", ul.KeepAlive, ul.DefaultHost, ul.FallbackHandler)
+	}
+	if ul.RequestIDVar != "HTTP_X_TRACE_ID" || !ul.GenerateRequestID || !ul.EchoRequestID {
+		t.Errorf("Unexpected request ID; got %q %v %v", ul.RequestIDVar, ul.GenerateRequestID, ul.EchoRequestID)
+	}
+	if len(ul.DeniedPeers) != 1 || ul.MaxConnsPerIP != 3 || !ul.InlineParse || !ul.UnboundedBody {
+		t.Errorf("Unexpected settings; got %v %d %v %v", ul.DeniedPeers, ul.MaxConnsPerIP, ul.InlineParse, ul.UnboundedBody)
+	}
+	if ul.SchemeVar != "HTTP_X_SCHEME" {
+		t.Errorf("Unexpected SchemeVar; got %q", ul.SchemeVar)
+	}
+}
@@ -0,0 +1,115 @@
+package uwsgi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+)
+
+// PacketHandler serves the uwsgi packets of a modifier1 other than
+// ModifierHTTP, e.g. ModifierCache or ModifierRPC, registered to
+// Listener.PacketHandlers. payload is the datasize bytes which follow the
+// header, not decoded since its format depends on the modifier. The
+// connection is owned by the handler, which writes the response to it and
+// should close it.
+type PacketHandler interface {
+	ServePacket(conn net.Conn, modifier1, modifier2 uint8, payload []byte)
+}
+
+// PacketHandlerFunc is an adapter to use a function as PacketHandler.
+type PacketHandlerFunc func(conn net.Conn, modifier1, modifier2 uint8, payload []byte)
+
+// ServePacket calls f(conn, modifier1, modifier2, payload).
+func (f PacketHandlerFunc) ServePacket(conn net.Conn, modifier1, modifier2 uint8, payload []byte) {
+	f(conn, modifier1, modifier2, payload)
+}
+
+// packetHandler returns the handler registered for modifier1, or nil. The
+// HTTP requests are always served by the HTTP server.
+func (l *Listener) packetHandler(modifier1 uint8) PacketHandler {
+	if modifier1 == ModifierHTTP {
+		return nil
+	}
+	return l.PacketHandlers[modifier1]
+}
+
+// WritePacket write the uwsgi packet of the vars, the header and the vars
+// block in the standard framing. The vars which have several values are
+// written as the same key repeated. The packet which can't be framed, i.e.
+// a key or a value, or the whole vars block, exceeds 65535 bytes, is an
+// error and nothing is written.
+func WritePacket(w io.Writer, modifier1, modifier2 uint8, vars map[string][]string) error {
+	size, err := varsSize(vars)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	head := [4]byte{modifier1, 0, 0, modifier2}
+	binary.LittleEndian.PutUint16(head[1:3], uint16(size))
+	bw.Write(head[:])
+
+	var b [2]byte
+	for k, v := range vars {
+		for _, vv := range v {
+			binary.LittleEndian.PutUint16(b[:], uint16(len(k)))
+			bw.Write(b[:])
+			bw.WriteString(k)
+			binary.LittleEndian.PutUint16(b[:], uint16(len(vv)))
+			bw.Write(b[:])
+			bw.WriteString(vv)
+		}
+	}
+	return bw.Flush()
+}
+
+// varsSize returns the size of the vars block in the standard framing, or
+// the error if it doesn't fit in the uint16 lengths.
+func varsSize(vars map[string][]string) (int, error) {
+	size := 0
+	for k, v := range vars {
+		if len(k) > math.MaxUint16 {
+			return 0, fmt.Errorf("uwsgi: key of %d bytes exceeds %d bytes", len(k), math.MaxUint16)
+		}
+		for _, vv := range v {
+			if len(vv) > math.MaxUint16 {
+				return 0, fmt.Errorf("uwsgi: value of %s of %d bytes exceeds %d bytes", k, len(vv), math.MaxUint16)
+			}
+			size += 2 + len(k) + 2 + len(vv)
+		}
+	}
+	if size > math.MaxUint16 {
+		return 0, fmt.Errorf("uwsgi: vars of %d bytes exceed %d bytes", size, math.MaxUint16)
+	}
+	return size, nil
+}
+
+// ReadPacket read the uwsgi packet in the standard framing, and decode its
+// payload as the vars. The payload of the modifier which is not vars, e.g.
+// ModifierPing, is decoded as well, so use Listener.PacketHandlers for it.
+func ReadPacket(r io.Reader) (modifier1, modifier2 uint8, vars map[string][]string, err error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	vars, err = Decoder{}.readVars(r, int(binary.LittleEndian.Uint16(head[1:3])))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return head[0], head[3], vars, nil
+}
+
+// readVars read the vars block of size from r and decode it. The block is
+// read into a pooled buffer, since the vars are copied out by Decode.
+func (d Decoder) readVars(r io.Reader, size int) (map[string][]string, error) {
+	b := getBuf(size)
+	defer putBuf(b)
+	buf := (*b)[:size]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return d.Decode(buf)
+}
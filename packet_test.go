@@ -0,0 +1,107 @@
+package uwsgi
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPacketHandlers(t *testing.T) {
+	var got [3][]byte
+	rpc := PacketHandlerFunc(func(conn net.Conn, modifier1, modifier2 uint8, payload []byte) {
+		defer conn.Close()
+		got[0], got[1] = []byte{modifier1, modifier2}, payload
+		conn.Write(append([]byte("reply:"), payload...))
+	})
+	ul := &Listener{PacketHandlers: map[uint8]PacketHandler{
+		ModifierRPC:  rpc,
+		ModifierHTTP: rpc,
+	}}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got[2] = []byte(r.URL.Path)
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	fd.Write([]byte{ModifierRPC, 5, 0, 1})
+	fd.Write([]byte("hello"))
+	fd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := ioutil.ReadAll(fd)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if string(reply) != "reply:hello" {
+		t.Errorf("Unexpected reply; got %q; expected %q", reply, "reply:hello")
+	}
+	if !bytes.Equal(got[0], []byte{ModifierRPC, 1}) || string(got[1]) != "hello" {
+		t.Errorf("Unexpected packet; got modifiers %v payload %q", got[0], got[1])
+	}
+
+	// ModifierHTTP is always served by the HTTP server.
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/http",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	}, "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(got[2]) != "/http" {
+		t.Errorf("Unexpected HTTP request; got %d %q", res.StatusCode, got[2])
+	}
+}
+
+func TestWriteReadPacket(t *testing.T) {
+	vars := map[string][]string{
+		"REQUEST_METHOD": {"GET"},
+		"HTTP_COOKIE":    {"a=1", "b=2"},
+		"EMPTY":          {""},
+	}
+	var buf bytes.Buffer
+	if err := WritePacket(&buf, ModifierRPC, 2, vars); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	packet := buf.Bytes()
+
+	m1, m2, got, err := ReadPacket(bytes.NewReader(packet))
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if m1 != ModifierRPC || m2 != 2 {
+		t.Errorf("Unexpected modifiers; got %d %d; expected %d %d", m1, m2, ModifierRPC, 2)
+	}
+	if !reflect.DeepEqual(got, vars) {
+		t.Errorf("Unexpected vars; got %v; expected %v", got, vars)
+	}
+
+	if _, _, _, err := ReadPacket(bytes.NewReader(packet[:len(packet)-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error for the truncated packet; got %v; expected %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestWritePacketTooLarge(t *testing.T) {
+	huge := strings.Repeat("x", 65536)
+	half := strings.Repeat("x", 40000)
+	for _, vars := range []map[string][]string{
+		{huge: {"v"}},
+		{"HTTP_COOKIE": {huge}},
+		{"HTTP_COOKIE": {half}, "HTTP_X_OTHER": {half}},
+		{"HTTP_COOKIE": {half, half}},
+	} {
+		var buf bytes.Buffer
+		if err := WritePacket(&buf, 0, 0, vars); err == nil {
+			t.Error("WritePacket should fail for the vars over 65535 bytes")
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Unexpected bytes written for the failed packet; got %d", buf.Len())
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package uwsgi
+
+import (
+	"net"
+)
+
+// allowedPeer reports whether the connection from addr may be served, by
+// AllowedPeers and DeniedPeers. The peer without IP address, e.g. on unix
+// socket, is always allowed.
+func (l *Listener) allowedPeer(addr net.Addr) bool {
+	if len(l.AllowedPeers) == 0 && len(l.DeniedPeers) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		return true
+	}
+	for _, n := range l.DeniedPeers {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(l.AllowedPeers) == 0 {
+		return true
+	}
+	for _, n := range l.AllowedPeers {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
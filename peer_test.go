@@ -0,0 +1,62 @@
+package uwsgi
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPeers(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		allowed, denied []*net.IPNet
+		served          bool
+	}{
+		{nil, nil, true},
+		{nil, []*net.IPNet{loopback}, false},
+		{[]*net.IPNet{private}, nil, false},
+		{[]*net.IPNet{loopback}, nil, true},
+		{[]*net.IPNet{loopback}, []*net.IPNet{loopback}, false},
+	}
+	for _, test := range tests {
+		called := make(chan bool, 1)
+		ul := &Listener{AllowedPeers: test.allowed, DeniedPeers: test.denied}
+		addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called <- true
+		}))
+
+		fd, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		writePacket(fd, map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"REQUEST_URI":     "/",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+		})
+		fd.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = fd.Read(make([]byte, 1))
+		fd.Close()
+		if test.served {
+			if err != nil {
+				t.Errorf("Unexpected error for allowed=%v denied=%v: %v", test.allowed, test.denied, err)
+			}
+			continue
+		}
+		if err != io.EOF {
+			if ne, ok := err.(*net.OpError); !ok || ne.Timeout() {
+				t.Errorf("Expected the connection to be closed for allowed=%v denied=%v; got %v", test.allowed, test.denied, err)
+			}
+		}
+		select {
+		case <-called:
+			t.Errorf("Unexpected handler call for allowed=%v denied=%v", test.allowed, test.denied)
+		default:
+		}
+	}
+}
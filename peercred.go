@@ -0,0 +1,39 @@
+package uwsgi
+
+import (
+	"net"
+	"net/http"
+)
+
+// Ucred is the credentials of the process at the other end of a unix socket.
+type Ucred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// PeerCred returns the credentials of the peer of the unix socket c by
+// SO_PEERCRED, e.g. to allow only the front-end running as a specific user.
+// c is *net.UnixConn, or Conn accepted by Listener from it. This is
+// supported only on Linux; the error is returned on the other platforms.
+func PeerCred(c net.Conn) (*Ucred, error) {
+	if uc, ok := c.(*Conn); ok {
+		if uc.peerCred != nil {
+			return uc.peerCred, nil
+		}
+		c = uc.Conn
+	}
+	return peerCred(c)
+}
+
+// RequestPeerCred returns the credentials of the front-end which sent the
+// request over the unix socket, got by Listener when the connection was
+// accepted. It returns nil for the other connections, or if PeerCred is not
+// supported. This requires Handler or ConnContext.
+func RequestPeerCred(r *http.Request) *Ucred {
+	c, _ := r.Context().Value(connContextKey).(*Conn)
+	if c == nil {
+		return nil
+	}
+	return c.peerCred
+}
@@ -0,0 +1,29 @@
+package uwsgi
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func peerCred(c net.Conn) (*Ucred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("uwsgi: PeerCred needs a unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, serr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return &Ucred{Pid: cred.Pid, Uid: cred.Uid, Gid: cred.Gid}, nil
+}
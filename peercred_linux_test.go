@@ -0,0 +1,64 @@
+package uwsgi
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerCred(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uwsgi.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+
+	var got *Ucred
+	ul := &Listener{Listener: l}
+	server := &http.Server{ConnContext: ul.ConnContext, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = RequestPeerCred(r)
+	})}
+	go server.Serve(ul)
+	defer server.Close()
+
+	fd, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, testVars)
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	res.Body.Close()
+
+	if got == nil {
+		t.Fatal("RequestPeerCred should return the credentials of the unix socket")
+	}
+	if got.Pid != int32(os.Getpid()) || got.Uid != uint32(os.Getuid()) || got.Gid != uint32(os.Getgid()) {
+		t.Errorf("Unexpected credentials; got %+v", got)
+	}
+
+	if cred, err := PeerCred(fd); err != nil || cred.Pid != int32(os.Getpid()) {
+		t.Errorf("Unexpected credentials of the client side; got %+v, %v", cred, err)
+	}
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer tl.Close()
+	tc, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer tc.Close()
+	if _, err := PeerCred(tc); err == nil {
+		t.Error("PeerCred should fail for TCP")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package uwsgi
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCred(c net.Conn) (*Ucred, error) {
+	return nil, errors.New("uwsgi: PeerCred is not supported on this platform")
+}
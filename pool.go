@@ -0,0 +1,80 @@
+package uwsgi
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// connPool keeps idle connections to a backend.
+type connPool struct {
+	mu   sync.Mutex
+	idle []idleConn
+}
+
+type idleConn struct {
+	conn  *pooledConn
+	since time.Time
+}
+
+// pooledConn is the connection dialed for the pool.
+type pooledConn struct {
+	net.Conn
+	dialed time.Time
+}
+
+var connPools sync.Map
+
+// poolKey identifies the backend of a pool. The connections wrapped by
+// different TLS configs are not shared.
+type poolKey struct {
+	network string
+	addr    string
+	tls     *tls.Config
+}
+
+// getConnPool returns the pool for the backend.
+func getConnPool(key poolKey) *connPool {
+	p, _ := connPools.LoadOrStore(key, &connPool{})
+	return p.(*connPool)
+}
+
+// get returns an idle connection, or nil if there is none. The connections
+// idle longer than timeout, or dialed before lifetime if it is not zero, are
+// closed.
+func (p *connPool) get(timeout, lifetime time.Duration) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle) > 0 {
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(ic.since) < timeout && (lifetime == 0 || time.Since(ic.conn.dialed) < lifetime) {
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+	return nil
+}
+
+// put return the connection to the pool, or close it if the pool is full.
+func (p *connPool) put(conn net.Conn, max int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc, ok := conn.(*pooledConn)
+	if !ok || len(p.idle) >= max {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, idleConn{pc, time.Now()})
+}
+
+// closeIdle close all of the idle connections.
+func (p *connPool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ic := range p.idle {
+		ic.conn.Close()
+	}
+	p.idle = nil
+}
@@ -0,0 +1,205 @@
+package uwsgi
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startKeepAliveBackend serve the uwsgi requests with the response until the
+// connection is closed, and returns the address and the number of accepted
+// connections.
+func startKeepAliveBackend(t testing.TB, response string) (string, *int32) {
+	return startBackend(t, response, -1)
+}
+
+// startBackend is startKeepAliveBackend which closes the connection after
+// max responses, unless max is negative.
+func startBackend(t testing.TB, response string, max int) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var accepted int32
+	go func() {
+		for {
+			fd, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer fd.Close()
+				for n := 0; max < 0 || n < max; n++ {
+					var head [4]byte
+					if _, err := io.ReadFull(fd, head[:]); err != nil {
+						return
+					}
+					vars := make([]byte, binary.LittleEndian.Uint16(head[1:3]))
+					if _, err := io.ReadFull(fd, vars); err != nil {
+						return
+					}
+					fmt.Fprint(fd, response)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), &accepted
+}
+
+func TestPassengerConnReuse(t *testing.T) {
+	tests := []struct {
+		response string
+		accepted int32
+	}{
+		{"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", 1},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok", 2},
+	}
+	for _, test := range tests {
+		addr, accepted := startKeepAliveBackend(t, test.response)
+		front := httptest.NewServer(Passenger{Net: "tcp", Addr: addr, MaxIdleConns: 1})
+
+		for n := 0; n < 2; n++ {
+			res, err := http.Get(front.URL + "/")
+			if err != nil {
+				t.Fatalf("request error: %v", err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if string(body) != "ok" {
+				t.Errorf("Unexpected body; got %q; expected %q", string(body), "ok")
+			}
+		}
+		front.Close()
+
+		if got := atomic.LoadInt32(accepted); got != test.accepted {
+			t.Errorf("Unexpected number of connections for %q; got %d; expected %d", test.response, got, test.accepted)
+		}
+	}
+}
+
+func TestPassengerRetryIdleConn(t *testing.T) {
+	// The backend closes the connection after the response without telling
+	// it, as the backends with the idle timeout do.
+	addr, accepted := startBackend(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", 1)
+	p := Passenger{Net: "tcp", Addr: addr, MaxIdleConns: 1}
+	front := httptest.NewServer(p)
+	defer front.Close()
+	defer p.CloseIdleConnections()
+
+	for n := 0; n < 2; n++ {
+		res, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Errorf("Unexpected response #%d; got %d %q; expected %d %q", n, res.StatusCode, body, http.StatusOK, "ok")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(accepted); got != 2 {
+		t.Errorf("Unexpected number of connections; got %d; expected %d", got, 2)
+	}
+}
+
+func TestPassengerIdleTimeout(t *testing.T) {
+	addr, accepted := startKeepAliveBackend(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	p := Passenger{Net: "tcp", Addr: addr, MaxIdleConns: 1, IdleTimeout: 10 * time.Millisecond}
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	for n := 0; n < 2; n++ {
+		res, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		res.Body.Close()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(accepted); got != 2 {
+		t.Errorf("Unexpected number of connections; got %d; expected %d", got, 2)
+	}
+
+	p.CloseIdleConnections()
+	if conn := getConnPool(p.poolKey()).get(time.Hour, 0); conn != nil {
+		t.Error("Idle connection is not closed")
+	}
+}
+
+func TestPassengerMaxConnLifetime(t *testing.T) {
+	addr, accepted := startKeepAliveBackend(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	p := Passenger{Net: "tcp", Addr: addr, MaxIdleConns: 1, MaxConnLifetime: 100 * time.Millisecond}
+	front := httptest.NewServer(p)
+	defer front.Close()
+	defer p.CloseIdleConnections()
+
+	// The first two share the connection, and the third dials again.
+	for _, wait := range []time.Duration{0, 0, 200 * time.Millisecond} {
+		time.Sleep(wait)
+		res, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		res.Body.Close()
+	}
+	if got := atomic.LoadInt32(accepted); got != 2 {
+		t.Errorf("Unexpected number of connections; got %d; expected %d", got, 2)
+	}
+}
+
+func BenchmarkPassenger(b *testing.B) {
+	for _, idle := range []int{0, 4} {
+		b.Run(fmt.Sprintf("MaxIdleConns=%d", idle), func(b *testing.B) {
+			addr, _ := startKeepAliveBackend(b, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			p := Passenger{Net: "tcp", Addr: addr, MaxIdleConns: idle}
+			defer p.CloseIdleConnections()
+			for n := 0; n < b.N; n++ {
+				w := httptest.NewRecorder()
+				p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+				if w.Code != http.StatusOK {
+					b.Fatalf("Unexpected status; got %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestPassengerPoolIsolation(t *testing.T) {
+	addr, _ := startKeepAliveBackend(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	plain := Passenger{Net: "tcp", Addr: addr, MaxIdleConns: 1}
+	defer plain.CloseIdleConnections()
+	plain.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// The Passenger with Dial doesn't pick up the idle connection of the
+	// default dialer.
+	var dialed int32
+	custom := plain
+	custom.Dial = func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		return net.Dial(network, addr)
+	}
+	for n := 0; n < 2; n++ {
+		custom.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if got := atomic.LoadInt32(&dialed); got != 2 {
+		t.Errorf("Unexpected number of dials; got %d; expected %d", got, 2)
+	}
+
+	secure := plain
+	secure.TLSConfig = &tls.Config{}
+	if getConnPool(secure.poolKey()) == getConnPool(plain.poolKey()) {
+		t.Error("The pool is shared by the Passengers with the different TLSConfig")
+	}
+}
@@ -0,0 +1,118 @@
+package uwsgi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Server serves uwsgi requests with http.Server, wired with Listener, its
+// Handler and ConnContext, and the timeouts. The zero value serves
+// http.DefaultServeMux with DefaultHeaderTimeout. For the settings which are
+// not here, use Listener and http.Server directly.
+//
+//	s := &uwsgi.Server{Handler: mux, ReadTimeout: time.Minute}
+//	go s.ListenAndServe("unix", "/path/to/socket")
+//	...
+//	s.Shutdown(ctx)
+type Server struct {
+	// Handler serves the requests. If nil, http.DefaultServeMux is used.
+	Handler http.Handler
+
+	// HeaderTimeout is Listener.HeaderTimeout. Zero means
+	// DefaultHeaderTimeout.
+	HeaderTimeout time.Duration
+
+	// ReadTimeout, WriteTimeout and IdleTimeout are the ones of
+	// http.Server.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// ErrorLog logs the errors of the connections and of the handlers, as
+	// Listener.ErrorLog and http.Server.ErrorLog. If nil, the errors of the
+	// connections are not logged, and the others go to the standard logger.
+	ErrorLog *log.Logger
+
+	// Options are applied to Listener after the fields above.
+	Options []Option
+
+	mu     sync.Mutex
+	server *http.Server
+	closed bool
+}
+
+var errServerStarted = errors.New("uwsgi: Server is already serving")
+
+// ListenAndServe listen on the network address and call Serve. The unix
+// socket is listened by SafeListenUnix.
+func (s *Server) ListenAndServe(network, addr string) error {
+	var inner net.Listener
+	var err error
+	if network == "unix" {
+		inner, err = SafeListenUnix(addr)
+	} else {
+		inner, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return err
+	}
+	return s.Serve(inner)
+}
+
+// Serve accept the connections on inner and serve the requests. It always
+// returns a non-nil error; http.ErrServerClosed after Shutdown.
+func (s *Server) Serve(inner net.Listener) error {
+	l := NewListener(inner, WithErrorLog(s.ErrorLog))
+	if s.HeaderTimeout > 0 {
+		l.HeaderTimeout = s.HeaderTimeout
+	}
+	for _, opt := range s.Options {
+		opt(l)
+	}
+
+	handler := s.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	server := &http.Server{
+		Handler:      l.Handler(handler),
+		ConnContext:  l.ConnContext,
+		ReadTimeout:  s.ReadTimeout,
+		WriteTimeout: s.WriteTimeout,
+		IdleTimeout:  s.IdleTimeout,
+		ErrorLog:     s.ErrorLog,
+	}
+
+	s.mu.Lock()
+	if s.closed || s.server != nil {
+		closed := s.closed
+		s.mu.Unlock()
+		inner.Close()
+		if closed {
+			return http.ErrServerClosed
+		}
+		return errServerStarted
+	}
+	s.server = server
+	s.mu.Unlock()
+	return server.Serve(l)
+}
+
+// Shutdown stop the server gracefully by http.Server.Shutdown: the listener
+// is closed, and the active requests are waited until ctx is done. Serve
+// after Shutdown returns http.ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	server := s.server
+	s.closed = true
+	s.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
@@ -0,0 +1,66 @@
+package uwsgi
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "uwsgi.sock")
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(RequestID(r.Context())))
+		}),
+		ReadTimeout: 5 * time.Second,
+		Options:     []Option{WithRequestID("", false, true)},
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe("unix", sock) }()
+
+	var fd net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if fd, err = net.Dial("unix", sock); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, map[string]string{
+		"REQUEST_METHOD":    "GET",
+		"REQUEST_URI":       "/",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"HTTP_HOST":         "localhost",
+		"HTTP_X_REQUEST_ID": "abc",
+	})
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "abc" || res.Header.Get("X-Request-Id") != "abc" {
+		t.Errorf("Unexpected response; got %q with X-Request-Id %q; expected %q", body, res.Header.Get("X-Request-Id"), "abc")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown error: %v", err)
+	}
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("Unexpected error of ListenAndServe; got %v; expected %v", err, http.ErrServerClosed)
+	}
+	if err := s.ListenAndServe("unix", sock); err != http.ErrServerClosed {
+		t.Errorf("Unexpected error after Shutdown; got %v; expected %v", err, http.ErrServerClosed)
+	}
+}
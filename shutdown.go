@@ -0,0 +1,61 @@
+package uwsgi
+
+import (
+	"context"
+	"time"
+)
+
+// track the connection until it is released, for Shutdown. It returns false
+// after Shutdown is called.
+func (l *Listener) track(c *Conn) bool {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	if l.shutdown {
+		return false
+	}
+	if l.conns == nil {
+		l.conns = make(map[*Conn]struct{})
+	}
+	l.conns[c] = struct{}{}
+	return true
+}
+
+func (l *Listener) untrack(c *Conn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	delete(l.conns, c)
+}
+
+// Shutdown stop accepting new connections, and wait for the connections
+// accepted already, which are parsing the packet or serving the request, to
+// be closed. If ctx is done before that, the connections are closed and the
+// error of ctx is returned. The connections detached by TunnelHandler and
+// PacketHandlers are not waited. With http.Server, call its Shutdown
+// instead, which closes Listener and the idle connections, and waits for the
+// active ones.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.connsMu.Lock()
+	l.shutdown = true
+	l.connsMu.Unlock()
+	err := l.Listener.Close()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		l.connsMu.Lock()
+		n := len(l.conns)
+		l.connsMu.Unlock()
+		if n == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			l.connsMu.Lock()
+			for c := range l.conns {
+				c.Conn.Close()
+			}
+			l.connsMu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
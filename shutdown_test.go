@@ -0,0 +1,83 @@
+package uwsgi
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	ul := &Listener{}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("done"))
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, testVars)
+	time.Sleep(50 * time.Millisecond)
+
+	// The active request finishes before Shutdown returns.
+	done := make(chan error, 1)
+	go func() { done <- ul.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned before the request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("New connection is accepted after Shutdown")
+	}
+	close(release)
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "done" {
+		t.Errorf("Unexpected body; got %q; expected %q", string(body), "done")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown hung")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	ul := &Listener{}
+	addr := startListener(t, ul, http.NotFoundHandler())
+
+	// The connection which never sends the packet is closed at the deadline.
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := ul.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error; got %v; expected %v", err, context.DeadlineExceeded)
+	}
+	fd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fd.Read(make([]byte, 1)); err == nil {
+		t.Error("Connection is not closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("Connection is not closed")
+	}
+}
@@ -0,0 +1,105 @@
+package uwsgi
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServeConn read one uwsgi packet from conn, serve it with handler, and write
+// the response to conn. It returns after the response is written and conn is
+// closed. This is for the CGI-style invocation which starts a process per
+// request.
+func ServeConn(conn io.ReadWriteCloser, handler http.Handler) error {
+	c := &rwConn{ReadWriteCloser: conn, done: make(chan struct{})}
+	l := &Listener{Listener: &oneConnListener{conn: c}}
+	server := &http.Server{Handler: handler, ConnContext: l.ConnContext}
+	if err := server.Serve(l); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// ServeStdio is ServeConn with the request on stdin and the response to
+// stdout.
+func ServeStdio(handler http.Handler) error {
+	return ServeConn(stdio{os.Stdin, os.Stdout}, handler)
+}
+
+type stdio struct {
+	in, out *os.File
+}
+
+func (s stdio) Read(b []byte) (int, error)  { return s.in.Read(b) }
+func (s stdio) Write(b []byte) (int, error) { return s.out.Write(b) }
+func (s stdio) Close() error                { return s.out.Close() }
+
+func (s stdio) SetReadDeadline(t time.Time) error  { return s.in.SetReadDeadline(t) }
+func (s stdio) SetWriteDeadline(t time.Time) error { return s.out.SetWriteDeadline(t) }
+
+// oneConnListener returns conn once, and io.EOF after conn is closed.
+type oneConnListener struct {
+	conn     *rwConn
+	accepted bool
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.conn.done
+	return nil, io.EOF
+}
+
+func (l *oneConnListener) Close() error {
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return rwAddr{}
+}
+
+// rwConn is net.Conn of io.ReadWriteCloser. The deadlines are passed to the
+// underlying one if supported, as http.Server needs them to stop reading.
+type rwConn struct {
+	io.ReadWriteCloser
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *rwConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}
+
+func (c *rwConn) LocalAddr() net.Addr  { return rwAddr{} }
+func (c *rwConn) RemoteAddr() net.Addr { return rwAddr{} }
+
+func (c *rwConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *rwConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *rwConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+type rwAddr struct{}
+
+func (rwAddr) Network() string { return "stdio" }
+func (rwAddr) String() string  { return "stdio" }
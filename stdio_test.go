@@ -0,0 +1,52 @@
+package uwsgi
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeConn(server, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(r.URL.Path + ":" + string(body)))
+		}))
+	}()
+
+	go func() {
+		writePacket(client, map[string]string{
+			"REQUEST_METHOD":  "POST",
+			"REQUEST_URI":     "/cgi",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+			"CONTENT_LENGTH":  "5",
+		})
+		client.Write([]byte("hello"))
+	}()
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "/cgi:hello" {
+		t.Errorf("Unexpected body; got %q; expected %q", string(body), "/cgi:hello")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn doesn't return after the response")
+	}
+}
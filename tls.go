@@ -0,0 +1,183 @@
+package uwsgi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"TLSv1":   tls.VersionTLS10,
+	"TLSv1.1": tls.VersionTLS11,
+	"TLSv1.2": tls.VersionTLS12,
+	"TLSv1.3": tls.VersionTLS13,
+}
+
+// opensslCiphers map OpenSSL cipher names to cipher suites. The IANA names
+// which are used by TLS 1.3 and by some front-ends are looked up from
+// tls.CipherSuites.
+var opensslCiphers = map[string]uint16{
+	"ECDHE-ECDSA-AES128-GCM-SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"ECDHE-RSA-AES128-GCM-SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"ECDHE-ECDSA-AES256-GCM-SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"ECDHE-RSA-AES256-GCM-SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"ECDHE-ECDSA-CHACHA20-POLY1305": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	"ECDHE-RSA-CHACHA20-POLY1305":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	"ECDHE-ECDSA-AES128-SHA256":     tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"ECDHE-RSA-AES128-SHA256":       tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"ECDHE-ECDSA-AES128-SHA":        tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"ECDHE-RSA-AES128-SHA":          tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"ECDHE-ECDSA-AES256-SHA":        tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"ECDHE-RSA-AES256-SHA":          tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"AES128-GCM-SHA256":             tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"AES256-GCM-SHA384":             tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"AES128-SHA256":                 tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"AES128-SHA":                    tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"AES256-SHA":                    tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"DES-CBC3-SHA":                  tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+}
+
+func cipherSuite(name string) uint16 {
+	if id, ok := opensslCiphers[name]; ok {
+		return id
+	}
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID
+		}
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.Name == name {
+			return cs.ID
+		}
+	}
+	return 0
+}
+
+// scheme returns the scheme of the request, or empty string if unknown.
+// SchemeVar from a trusted peer wins over HTTPS, REQUEST_SCHEME, UWSGI_SCHEME
+// and the SSL vars. The values other than http and https are ignored.
+func (l *Listener) scheme(env map[string][]string) string {
+	if v, ok := env[l.schemeVar()]; ok && l.trusted(env) {
+		// The first one is the nearest to the client.
+		if scheme := validScheme(strings.Split(v[0], ",")[0]); scheme != "" {
+			return scheme
+		}
+	}
+	if v, ok := env["HTTPS"]; ok && (strings.EqualFold(v[0], "on") || v[0] == "1") {
+		return "https"
+	}
+	if v, ok := env["REQUEST_SCHEME"]; ok {
+		if scheme := validScheme(v[0]); scheme != "" {
+			return scheme
+		}
+	}
+	if v, ok := env["UWSGI_SCHEME"]; ok {
+		if scheme := validScheme(v[0]); scheme != "" {
+			return scheme
+		}
+	}
+	_, hasProto := env["SSL_PROTOCOL"]
+	_, hasCipher := env["SSL_CIPHER"]
+	if hasProto || hasCipher {
+		return "https"
+	}
+	return ""
+}
+
+func (l *Listener) schemeVar() string {
+	if l.SchemeVar != "" {
+		return l.SchemeVar
+	}
+	return "HTTP_X_FORWARDED_PROTO"
+}
+
+// validScheme returns the lowercased scheme if it is http or https, or empty
+// string otherwise.
+func validScheme(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s != "http" && s != "https" {
+		return ""
+	}
+	return s
+}
+
+// trusted reports whether REMOTE_ADDR is in TrustedProxies.
+func (l *Listener) trusted(env map[string][]string) bool {
+	v, ok := env["REMOTE_ADDR"]
+	if !ok {
+		return false
+	}
+	ip := net.ParseIP(v[0])
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTLS reports whether the request arrived at the front-end over TLS. It
+// works with the request from Handler, or from ConnContext without Handler.
+func IsTLS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if c, ok := r.Context().Value(connContextKey).(*Conn); ok {
+		env, _ := c.request()
+		return c.l.scheme(env) == "https"
+	}
+	return false
+}
+
+// tlsState returns best-effort connection state built from SSL_PROTOCOL,
+// SSL_CIPHER and the client certificate.
+func tlsState(env map[string][]string) *tls.ConnectionState {
+	proto, hasProto := env["SSL_PROTOCOL"]
+	cipher, hasCipher := env["SSL_CIPHER"]
+
+	state := &tls.ConnectionState{HandshakeComplete: true}
+	if hasProto {
+		state.Version = tlsVersions[proto[0]]
+	}
+	if hasCipher {
+		state.CipherSuite = cipherSuite(cipher[0])
+	}
+	if cert := clientCertificate(env); cert != nil {
+		state.PeerCertificates = []*x509.Certificate{cert}
+	}
+	return state
+}
+
+// clientCertificate parse the PEM client certificate in SSL_CLIENT_CERT or
+// HTTPS_CLIENT_CERT. Both of $ssl_client_escaped_cert, which is URL-encoded,
+// and $ssl_client_cert of nginx, which has tabs at the head of lines, are
+// accepted.
+func clientCertificate(env map[string][]string) *x509.Certificate {
+	for _, k := range []string{"SSL_CLIENT_CERT", "HTTPS_CLIENT_CERT"} {
+		v := firstVar(env, k)
+		if v == "" {
+			continue
+		}
+		if strings.HasPrefix(v, "-----BEGIN%20") {
+			if u, err := url.PathUnescape(v); err == nil {
+				v = u
+			}
+		}
+		block, _ := pem.Decode([]byte(strings.Replace(v, "\t", "", -1)))
+		if block == nil || block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			return cert
+		}
+	}
+	return nil
+}
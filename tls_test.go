@@ -0,0 +1,212 @@
+package uwsgi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSState(t *testing.T) {
+	var state *tls.ConnectionState
+	ul := &Listener{}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state = r.TLS
+	})))
+
+	m := map[string]string{
+		"REQUEST_METHOD":        "GET",
+		"REQUEST_URI":           "/",
+		"SERVER_PROTOCOL":       "HTTP/1.1",
+		"HTTP_HOST":             "localhost",
+		"SSL_PROTOCOL":          "TLSv1.2",
+		"SSL_CIPHER":            "ECDHE-RSA-AES128-GCM-SHA256",
+		"SSL_CIPHER_USEKEYSIZE": "128",
+	}
+	res := doRequest(t, addr, m, "")
+	res.Body.Close()
+
+	if state == nil {
+		t.Fatal("r.TLS should be set")
+	}
+	if state.Version != tls.VersionTLS12 {
+		t.Errorf("Unexpected version; got %x; expected %x", state.Version, tls.VersionTLS12)
+	}
+	if state.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected cipher suite; got %s", tls.CipherSuiteName(state.CipherSuite))
+	}
+
+	delete(m, "SSL_PROTOCOL")
+	delete(m, "SSL_CIPHER")
+	res = doRequest(t, addr, m, "")
+	res.Body.Close()
+	if state != nil {
+		t.Errorf("r.TLS should be nil without SSL vars; got %v", state)
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	var scheme string
+	var secure bool
+	ul := &Listener{TrustedProxies: []*net.IPNet{trusted}}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme = r.URL.Scheme
+		secure = r.TLS != nil
+	})))
+
+	tests := []struct {
+		remote string
+		https  string
+		scheme string
+	}{
+		{"10.0.0.1", "", "https"},
+		{"10.0.0.1", "on", "http"},
+		{"192.168.0.1", "", ""},
+		{"192.168.0.1", "on", "https"},
+	}
+	for _, test := range tests {
+		m := map[string]string{
+			"REQUEST_METHOD":         "GET",
+			"REQUEST_URI":            "/",
+			"SERVER_PROTOCOL":        "HTTP/1.1",
+			"HTTP_HOST":              "localhost",
+			"REMOTE_ADDR":            test.remote,
+			"HTTP_X_FORWARDED_PROTO": "https",
+		}
+		if test.https != "" {
+			m["HTTP_X_FORWARDED_PROTO"] = "http"
+			m["HTTPS"] = test.https
+		}
+		res := doRequest(t, addr, m, "")
+		res.Body.Close()
+
+		if scheme != test.scheme {
+			t.Errorf("Unexpected scheme for %v; got %q; expected %q", test, scheme, test.scheme)
+		}
+		if secure != (test.scheme == "https") {
+			t.Errorf("Unexpected r.TLS for %v; got %v", test, secure)
+		}
+	}
+}
+
+func TestSchemeVar(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	ul := &Listener{TrustedProxies: []*net.IPNet{trusted}, SchemeVar: "HTTP_X_SCHEME"}
+	tests := []struct {
+		vars   map[string][]string
+		scheme string
+	}{
+		{map[string][]string{"HTTP_X_SCHEME": {"HTTPS"}}, "https"},
+		{map[string][]string{"HTTP_X_FORWARDED_PROTO": {"https"}}, ""},
+		{map[string][]string{"HTTP_X_SCHEME": {"javascript"}}, ""},
+		{map[string][]string{"HTTP_X_SCHEME": {"ftp"}, "REQUEST_SCHEME": {"https"}}, "https"},
+		{map[string][]string{"REQUEST_SCHEME": {"gopher"}}, ""},
+		{map[string][]string{"UWSGI_SCHEME": {"Http"}}, "http"},
+	}
+	for _, test := range tests {
+		test.vars["REMOTE_ADDR"] = []string{"10.0.0.1"}
+		if got := ul.scheme(test.vars); got != test.scheme {
+			t.Errorf("Unexpected scheme for %v; got %q; expected %q", test.vars, got, test.scheme)
+		}
+	}
+}
+
+func TestCipherSuite(t *testing.T) {
+	if got := cipherSuite("TLS_AES_128_GCM_SHA256"); got != tls.TLS_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected cipher suite; got %x", got)
+	}
+	if got := cipherSuite("UNKNOWN"); got != 0 {
+		t.Errorf("Unexpected cipher suite; got %x", got)
+	}
+}
+
+func TestIsTLS(t *testing.T) {
+	var secure bool
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secure = IsTLS(r)
+	}))
+
+	tests := []struct {
+		k, v     string
+		expected bool
+	}{
+		{"HTTPS", "on", true},
+		{"REQUEST_SCHEME", "https", true},
+		{"UWSGI_SCHEME", "https", true},
+		{"UWSGI_SCHEME", "http", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		m := map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"REQUEST_URI":     "/",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+		}
+		if test.k != "" {
+			m[test.k] = test.v
+		}
+		res := doRequest(t, addr, m, "")
+		res.Body.Close()
+		if secure != test.expected {
+			t.Errorf("Unexpected IsTLS for %s=%q; got %v; expected %v", test.k, test.v, secure, test.expected)
+		}
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client.example"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	var state *tls.ConnectionState
+	ul := &Listener{}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state = r.TLS
+	})))
+
+	for _, v := range []string{
+		url.PathEscape(cert),
+		strings.Replace(strings.TrimSuffix(cert, "\n"), "\n", "\n\t", -1),
+	} {
+		state = nil
+		res := doRequest(t, addr, map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"REQUEST_URI":     "/",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+			"HTTPS":           "on",
+			"SSL_CLIENT_CERT": v,
+		}, "")
+		res.Body.Close()
+		if state == nil || len(state.PeerCertificates) != 1 {
+			t.Fatalf("Client certificate should be set for %q; got %v", v, state)
+		}
+		if cn := state.PeerCertificates[0].Subject.CommonName; cn != "client.example" {
+			t.Errorf("Unexpected CommonName; got %q; expected %q", cn, "client.example")
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package uwsgi
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Transport is http.RoundTripper which talk to the uWSGI backend. This can
+// be used as Transport of httputil.ReverseProxy:
+//
+//	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: "backend"})
+//	proxy.Transport = &uwsgi.Transport{Net: "unix", Addr: "/path/to/socket"}
+//	http.ListenAndServe(":8080", proxy)
+//
+// The scheme and host of the target URL are only used to fill SERVER_NAME
+// and SERVER_PORT; the connection is always made to Net and Addr.
+type Transport struct {
+	Net  string
+	Addr string
+}
+
+// RoundTrip send the request as uWSGI packet and read the response. The
+// context of the request aborts the dial and the exchange, including the
+// read of the response body.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(req.Context(), t.Net, t.Addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(req.Context(), conn)
+	fail := func(err error) (*http.Response, error) {
+		stop()
+		conn.Close()
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	// The outgoing request may be rewritten, e.g. by the Director of
+	// httputil.ReverseProxy, which keeps the inbound RequestURI.
+	vars := requestVars(req)
+	vars["REQUEST_URI"] = []string{req.URL.RequestURI()}
+	if err := WritePacket(conn, ModifierHTTP, 0, vars); err != nil {
+		return fail(err)
+	}
+	if req.Body != nil {
+		if _, err := io.Copy(conn, req.Body); err != nil {
+			return fail(err)
+		}
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fail(err)
+	}
+	res.Body = &connBody{ReadCloser: res.Body, conn: conn, stop: stop}
+	return res, nil
+}
+
+// connBody close the connection when the response body is closed. stop, if
+// not nil, ends the watch of the request context.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+	stop func() bool
+	once sync.Once
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		if b.stop != nil {
+			b.stop()
+		}
+		b.conn.Close()
+	})
+	return err
+}
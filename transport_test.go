@@ -0,0 +1,99 @@
+package uwsgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransportReverseProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Backend", "uwsgi")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + string(body)))
+	})}
+	go backend.Serve(&Listener{Listener: l})
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: "backend"})
+	proxy.Transport = &Transport{Net: "tcp", Addr: l.Addr().String()}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	res, err := http.Post(front.URL+"/foo?bar=baz", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("post error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("Unexpected status; got %d; expected %d", res.StatusCode, http.StatusCreated)
+	}
+	if got := res.Header.Get("X-Backend"); got != "uwsgi" {
+		t.Errorf("Unexpected header; got %q; expected %q", got, "uwsgi")
+	}
+	expected := "POST /foo?bar=baz hello"
+	if string(body) != expected {
+		t.Errorf("Unexpected body; got %q; expected %q", string(body), expected)
+	}
+}
+
+func TestTransportTargetPath(t *testing.T) {
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: "backend", Path: "/base"})
+	proxy.Transport = &Transport{Net: "tcp", Addr: addr}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	res, err := http.Get(front.URL + "/x?q=1")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if expected := "/base/x?q=1"; string(body) != expected {
+		t.Errorf("Unexpected request URI; got %q; expected %q", string(body), expected)
+	}
+}
+
+func TestTransportCancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://backend/", nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := (&Transport{Net: "tcp", Addr: addr}).RoundTrip(req)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Unexpected error; got %v; expected %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RoundTrip is not canceled")
+	}
+}
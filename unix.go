@@ -0,0 +1,38 @@
+package uwsgi
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// SafeListenUnix listen on the unix socket path. A stale socket file left by
+// the previous process is removed, but if another process is still
+// listening on it, SafeListenUnix returns an error instead of clobbering the
+// live instance. The socket file is removed only when the connection to it is
+// refused; the other errors of the dial are returned as is.
+func SafeListenUnix(path string) (net.Listener, error) {
+	fi, err := os.Lstat(path)
+	if err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", path)
+		}
+		// Only the refused connection tells the socket is stale. The
+		// live instance may be busy, e.g. with the full backlog, or not
+		// permitted to connect to.
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
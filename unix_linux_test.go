@@ -0,0 +1,39 @@
+package uwsgi
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSafeListenUnixBusy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uwsgi.sock")
+
+	// The live instance which doesn't accept, with the backlog of one.
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socket error: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		t.Fatalf("bind error: %v", err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+
+	if l, err := SafeListenUnix(path); err == nil {
+		l.Close()
+		t.Fatal("SafeListenUnix should fail for the busy socket")
+	}
+	if _, err := os.Lstat(path); err != nil {
+		t.Errorf("The busy socket should be kept: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package uwsgi
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uwsgi.sock")
+
+	// Leave the stale socket file.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	l, err = SafeListenUnix(path)
+	if err != nil {
+		t.Fatalf("SafeListenUnix should remove the stale socket: %v", err)
+	}
+	defer l.Close()
+
+	if l2, err := SafeListenUnix(path); err == nil {
+		l2.Close()
+		t.Fatal("SafeListenUnix should fail for the live socket")
+	}
+	if conn, err := net.Dial("unix", path); err != nil {
+		t.Errorf("The live socket should be kept: %v", err)
+	} else {
+		conn.Close()
+	}
+}
@@ -4,7 +4,7 @@ This implements run as net.Listener:
 
 
 		l, err = net.Listen("unix", "/path/to/socket")
-		http.Serve(&UwsgiListener{l}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Serve(uwsgi.NewListener(l), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Content-Length", 11)
 			w.Write([]byte("hello world"))
 		})
@@ -15,113 +15,718 @@ package uwsgi
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
-	"regexp"
+	"net/textproto"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Modifiers of uwsgi packets.
+const (
+	// ModifierHTTP is modifier1 of the WSGI/HTTP request, which is served
+	// by Listener by default. modifier2 is 0 for it.
+	ModifierHTTP uint8 = 0
+
+	// ModifierPing is modifier1 of the ping request, which is answered by
+	// Listener with the empty ping response. See Listener.DisablePing.
+	ModifierPing uint8 = 100
+
+	// ModifierCache is modifier1 of the requests to the uWSGI cache and
+	// ModifierRPC is the one of the RPC requests. Listener serves them only
+	// by PacketHandlers.
+	ModifierCache uint8 = 111
+	ModifierRPC   uint8 = 173
+)
+
+// ModifierAction is the behavior for the packet of the modifier1 which is not
+// allowed. See Listener.UnsupportedModifierAction.
+type ModifierAction int
+
+const (
+	// ModifierClose close the connection without answering anything. The
+	// error is still reported to Listener.ErrorLog and Listener.OnError if
+	// set, but not to the standard logger.
+	ModifierClose ModifierAction = iota
+
+	// ModifierLog close the connection, and log the modifier to
+	// Listener.ErrorLog, or to the standard logger if ErrorLog is nil.
+	ModifierLog
+
+	// ModifierRespond close the connection after sending 400 which tells
+	// the modifier is not supported.
+	ModifierRespond
+)
+
 // Listener behave as net.Listener
 type Listener struct {
 	net.Listener
+
+	// AllowedModifiers is the list of modifier1 accepted by Listener. The
+	// packet which has another modifier1 is rejected before reading the
+	// vars. If empty, only ModifierHTTP is accepted; the other packets such
+	// as spooler or ping are not HTTP requests.
+	AllowedModifiers []uint8
+
+	// UnsupportedModifierAction is the behavior for the packet which has
+	// modifier1 not allowed by AllowedModifiers.
+	UnsupportedModifierAction ModifierAction
+
+	// ErrorLog, if not nil, logs the errors of the connections, e.g. the
+	// malformed packets from a misbehaving front-end or port scanners,
+	// with the remote address. The connection which sent nothing is not
+	// logged.
+	ErrorLog *log.Logger
+
+	// OnError, if not nil, is called with the same errors as ErrorLog and
+	// the underlying connection, which is closed already.
+	OnError func(conn net.Conn, err error)
+
+	// DisablePing disable the answer to the ping packet of ModifierPing,
+	// which is used by nginx and monitoring tools to check the liveness.
+	// The ping packet is dropped as other packets which are not allowed.
+	DisablePing bool
+
+	// MaxHeaders is the maximum number of header lines in the reconstructed
+	// request, including Host and Connection. The vars merged into a line,
+	// e.g. HTTP_COOKIE, count once, and the dropped ones don't count. The
+	// request which has more lines is rejected with 431. Zero means no
+	// limit.
+	MaxHeaders int
+
+	// HeaderMap maps the uwsgi vars to header names, before the default
+	// mapping: HTTP_ vars by the CGI rule, e.g. HTTP_X_REQUESTED_WITH to
+	// X-Requested-With, and the others as is. The var mapped to the empty
+	// name is dropped. The vars for the request line, Host, Content-Length,
+	// Content-Type, Cookie and Connection can't be mapped.
+	HeaderMap map[string]string
+
+	// DebugWriter, if not nil, receives the header block of every
+	// reconstructed request and the names of the uwsgi vars, for debugging
+	// the mapping. The body is never written.
+	DebugWriter io.Writer
+
+	// KeepAlive serve sequential requests on a connection, for the
+	// front-end which reuses connections. After the body of a request, the
+	// next uwsgi packet is read from the connection and presented to the
+	// HTTP server as the next request. HTTP_CONNECTION is passed through as
+	// Connection header, and "Connection: keep-alive" is added without it.
+	// The request whose body is not framed by CONTENT_LENGTH, e.g. chunked,
+	// is the last one of the connection. HeaderTimeout is applied only to
+	// the first packet; the server's IdleTimeout covers the wait for the
+	// next one. The front-end which pipelines, i.e. sends the next packet
+	// before the response, requires Handler; the packet is held until the
+	// server finished the response. Without Handler, the next request
+	// would replace the vars and the deadlines under the running handler.
+	// By default, HTTP_CONNECTION is dropped and "Connection: close" is
+	// added, so a connection serves one request.
+	KeepAlive bool
+
+	// RequestIDVar is the uwsgi var which carries the request ID. Default
+	// is HTTP_X_REQUEST_ID. See RequestID.
+	RequestIDVar string
+
+	// GenerateRequestID generate a random request ID when the request
+	// doesn't have RequestIDVar.
+	GenerateRequestID bool
+
+	// EchoRequestID set the request ID to the response header which is
+	// derived from RequestIDVar, X-Request-Id by default.
+	EchoRequestID bool
+
+	// TrustedProxies is the list of networks whose X-Forwarded-Proto is
+	// trusted. When REMOTE_ADDR is in the list, SchemeVar decides the
+	// scheme of the request. Otherwise HTTPS, REQUEST_SCHEME and the SSL
+	// vars are used. Only http and https are taken as the scheme.
+	TrustedProxies []*net.IPNet
+
+	// SchemeVar is the uwsgi var which carries the scheme from the trusted
+	// proxies. Default is HTTP_X_FORWARDED_PROTO.
+	SchemeVar string
+
+	// AllowedPeers and DeniedPeers are the networks of the front-ends which
+	// may connect. The connection from a peer in DeniedPeers, or not in
+	// AllowedPeers if it is not empty, is closed before anything is read.
+	// The peers without IP address, e.g. on unix socket, are not checked.
+	AllowedPeers []*net.IPNet
+	DeniedPeers  []*net.IPNet
+
+	// MaxConns is the maximum number of connections served at once. The
+	// connection over the limit waits for a slot before its vars are read,
+	// or is rejected with 503 if RejectOverLimit is set. Zero means no
+	// limit.
+	MaxConns        int
+	RejectOverLimit bool
+
+	// MaxConnsPerIP is the maximum number of connections served at once
+	// for a client, by REMOTE_ADDR. The connection over the limit is
+	// rejected with 503. Zero means no limit.
+	MaxConnsPerIP int
+
+	// CORS, if not nil, is used by Handler to answer CORS preflight
+	// requests without invoking the handler.
+	CORS *CORS
+
+	// DefaultHost is used as Host of the request which has neither
+	// HTTP_HOST nor SERVER_NAME. If empty, such requests are rejected with
+	// 400.
+	DefaultHost string
+
+	// PacketHandlers serve the packets of other modifier1 than ModifierHTTP
+	// in-process, by modifier1. The packet is dispatched in this order:
+	// raw HTTP to FallbackHandler, the modifier1 in PacketHandlers, ping by
+	// ModifierPing, and the rest by AllowedModifiers; the modifier1 in
+	// PacketHandlers is allowed implicitly, and overrides the answer to
+	// ping. A handler for ModifierHTTP is ignored, the HTTP requests are
+	// always given to the HTTP server. The packet is read under
+	// HeaderTimeout, and the connection is detached from the HTTP server as
+	// by TunnelHandler.
+	PacketHandlers map[uint8]PacketHandler
+
+	// TunnelHandler, if not nil, is called for CONNECT requests instead of
+	// the HTTP server. It receives the raw connection from the front-end,
+	// from which the tunneled bytes can be read, and the vars. The
+	// connection is owned by TunnelHandler and should be closed by it.
+	TunnelHandler func(conn net.Conn, env map[string][]string)
+
+	// OnShortBody, if not nil, is called when the connection reached EOF
+	// before CONTENT_LENGTH bytes of the body were read. This usually means
+	// a framing problem between the front-end and the backend.
+	OnShortBody func(c *Conn, declared, read int64)
+
+	// ResponseHook, if not nil, is called by Handler just before the
+	// response header is written, to set response headers from the vars.
+	ResponseHook func(env map[string][]string, h http.Header)
+
+	// StatusHook, if not nil, is called by Handler just before the
+	// response header is written, with the status code of the handler. It
+	// can translate the status into the directives for the front-end, e.g.
+	// X-Accel-Redirect to the error page of nginx.
+	StatusHook func(status int, h http.Header)
+
+	// LengthSize is the size of length prefixes of the uwsgi vars, 2 or 4.
+	// Zero means 2 which is the standard. Some forks of uWSGI use 4 bytes.
+	// This changes only the width of the prefix of each key and value; the
+	// datasize in the header is still 2 bytes, so the whole vars block is
+	// up to 65535 bytes either way.
+	LengthSize int
+
+	// ByteOrder is the byte order of the datasize in the header and of the
+	// length prefixes of the vars. Nil means binary.LittleEndian which is
+	// the standard. This is not standard; set binary.BigEndian only for the
+	// peer which is known to send big-endian lengths.
+	ByteOrder binary.ByteOrder
+
+	// URIFromPathInfo build the request URI from SCRIPT_NAME, PATH_INFO and
+	// QUERY_STRING instead of REQUEST_URI. By CGI, REQUEST_URI is the URI
+	// sent by the client as is, percent-encoded, while SCRIPT_NAME and
+	// PATH_INFO are decoded by the front-end. Set this for the front-end
+	// which encodes REQUEST_URI twice, or rewrites PATH_INFO without
+	// REQUEST_URI. The path is encoded again, so the encoding of the client
+	// e.g. %2F is lost.
+	URIFromPathInfo bool
+
+	// StripScriptName remove SCRIPT_NAME, the mount point of the
+	// application, from the path of the request, so the handler sees the
+	// path relative to the application as PATH_INFO. The path outside of
+	// the mount point is kept as is. ScriptName returns the mount point.
+	StripScriptName bool
+
+	// FallbackHandler, if not nil, serves the connection which sends a raw
+	// HTTP request instead of the uwsgi packet, so a Listener can serve
+	// both of the front-end and direct HTTP clients, e.g. while migrating.
+	// The connection is given to the HTTP server as is, and Handler passes
+	// its requests to FallbackHandler. This requires Handler and
+	// ConnContext.
+	FallbackHandler http.Handler
+
+	// MaxEnvSize is the maximum datasize of the packet, i.e. the size of
+	// the vars block. The connection which declares more is closed with
+	// the error before the block is read. Zero means 65535, the protocol
+	// maximum.
+	MaxEnvSize uint16
+
+	// MaxRequestBytes is the maximum number of bytes of the uwsgi packet and
+	// the body that a connection may consume. The request which declares
+	// more is rejected with 413, and the connection which reads more is
+	// closed with an error. Zero means no limit.
+	MaxRequestBytes int64
+
+	// InlineParse parse the uwsgi packet in the first Read of Conn, i.e. in
+	// the goroutine of the HTTP server, instead of the goroutine started by
+	// Accept. This halves the number of goroutines per connection, and puts
+	// the parse under the read deadlines of the server. On the other hand,
+	// MaxConns and TunnelHandler block the goroutine of the server, and the
+	// connection is parsed only after the server started reading it.
+	InlineParse bool
+
+	// HandlerTimeout is the time budget of a request from the accept of the
+	// connection. Handler sets the deadline of the request context by it,
+	// so the handler can pass the remaining budget to the backends. See
+	// Deadline and AcceptedAt. Zero means no deadline.
+	HandlerTimeout time.Duration
+
+	// HeaderTimeout is the maximum time to read the whole uwsgi packet, the
+	// header and the vars, after the connection is accepted. The
+	// connection which doesn't send it in time is closed with the timeout
+	// error, or quietly as io.EOF if it sent nothing, e.g. port scanners.
+	// Zero means no timeout other than the deadlines of the server.
+	// NewListener sets DefaultHeaderTimeout.
+	HeaderTimeout time.Duration
+
+	// RequestTimeout bounds the body read and the response write of a
+	// request on the connection, from the parse of the vars. It is set as
+	// the read and write deadlines of the underlying connection, so a
+	// stuck handler or a slow client gets a timeout error from Read or
+	// Write. The deadlines set by the server, e.g. by ReadTimeout and
+	// WriteTimeout of http.Server, still apply; the earlier one wins. Unlike
+	// HandlerTimeout, the request context is not canceled. With KeepAlive,
+	// the wait for the next packet is not bounded by it. Zero means no
+	// timeout.
+	RequestTimeout time.Duration
+
+	// Metrics, if not nil, receives the metrics of the connections, and of
+	// the requests served by Handler. If it implements RequestMetrics, the
+	// size and the latency of each request on the connection are observed
+	// too, after OnRequestComplete; see RequestMetrics.
+	Metrics Metrics
+
+	// UnboundedBody read the body of POST, PUT and PATCH without
+	// CONTENT_LENGTH nor HTTP_TRANSFER_ENCODING until the front-end shuts
+	// down writing, for the front-ends which stream the body of unknown
+	// length that way. The handler sees it as a chunked body. Without it,
+	// such a body is empty, as the stock uwsgi_params of nginx sends an
+	// empty CONTENT_LENGTH for the requests without body.
+	UnboundedBody bool
+
+	limit    sync.Once
+	sem      chan struct{}
+	inflight int64
+	queued   int64
+	waited   int64
+
+	perIPMu sync.Mutex
+	perIP   map[string]int
+
+	connsMu  sync.Mutex
+	conns    map[*Conn]struct{}
+	shutdown bool
+
+	debugMu sync.Mutex
 }
 
-// Conn is connection for uWSGI
+// Conn is connection for uWSGI. Conn implements net.Conn, so it can be passed
+// to any server which reads HTTP requests from net.Conn. Read blocks until
+// the uWSGI vars are parsed, then yields the reconstructed HTTP request line
+// and headers, and after those the request body read from the underlying
+// connection. Write, Close and the other methods go to the underlying
+// connection directly. Once the vars turned out to be invalid, every method
+// returns the error.
 type Conn struct {
 	net.Conn
-	env     map[string][]string
-	reader  io.Reader
-	hdrdone bool
-	ready   bool
-	readych chan bool
-	err     error
+	l        *Listener
+	reader   io.Reader
+	slot     int32
+	tunneled bool
+	raw      bool
+	peerIP   string
+	peerCred *Ucred
+	bodyRead int64
+	written  int64
+
+	// envMu guards the vars of the current request, which are replaced by
+	// the next packet of Listener.KeepAlive. They are written only by the
+	// reader of the packet. active is the number of the running Handler,
+	// which holds the next packet; see next.
+	active    int32
+	envMu     sync.RWMutex
+	env       map[string][]string
+	accepted  time.Time
+	declared  int64
+	envBytes  int64
+	modifier1 uint8
+	modifier2 uint8
+
+	// readMu serializes Read, which owns reader, chunked, hdrdone and
+	// inline. hdrbuf is the pooled buffer of the header block read by
+	// hdrReader, given back when hdrdone flips.
+	readMu    sync.Mutex
+	chunked   *chunkedBody
+	hdrdone   bool
+	inline    bool
+	hdrbuf    *[]byte
+	hdrReader bytes.Reader
+
+	// last is set when the request can't be followed by the next packet of
+	// Listener.KeepAlive. pkt accumulates the next packet, and pktStart is
+	// the time its first byte arrived.
+	last     bool
+	pkt      []byte
+	pktStart time.Time
+
+	// err is set by the parsing goroutine and read by the server. Once set,
+	// it is kept.
+	errMu sync.Mutex
+	err   error
+
+	// readych is closed when the vars have been processed, successfully or
+	// not.
+	readych    chan struct{}
+	signalOnce sync.Once
+
+	// closed is closed by Close, to stop waiting for a slot of MaxConns.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// readDeadline and writeDeadline are the deadlines set by the server,
+	// restored after Listener.HeaderTimeout. reqRead and reqWrite are the
+	// ones of Listener.RequestTimeout; the earlier one is set to the
+	// underlying connection. deadlinech is notified when readDeadline is
+	// changed.
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	reqRead       time.Time
+	reqWrite      time.Time
+	deadlinech    chan struct{}
 }
 
 func (c *Conn) Read(b []byte) (n int, e error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.inline {
+		c.inline = false
+		c.parse()
+	}
 	// Wait until headers have been processed
-	if !c.ready && c.err == nil {
-		<-c.readych
-		c.ready = true
+	<-c.readych
+	for {
+		if c.hdrdone && c.chunked != nil {
+			// The error of the body follows the last chunk.
+			return c.chunked.Read(b)
+		}
+		if err := c.loadErr(); err != nil {
+			return 0, err
+		}
+
+		// After headers have been read by HTTP server, transfer
+		// socket over to the underlying connection for direct read.
+		// The body is read into b as is, without intermediate buffer.
+		if !c.hdrdone {
+			n, e = c.reader.Read(b)
+			if n > 0 && e == nil {
+				return n, e
+			}
+			c.hdrdone = true
+			if c.hdrbuf != nil {
+				c.hdrReader.Reset(nil)
+				putBuf(c.hdrbuf)
+				c.hdrbuf = nil
+			}
+		}
+		if c.chunked != nil {
+			return c.chunked.Read(b)
+		}
+		if !c.keepAlive() {
+			return c.readBody(b)
+		}
+		if remain := c.declared - atomic.LoadInt64(&c.bodyRead); remain > 0 {
+			if int64(len(b)) > remain {
+				b = b[:remain]
+			}
+			return c.readBody(b)
+		}
+		// The body is done. The server reads the next request.
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readBody read the body from the socket, up to Listener.MaxRequestBytes.
+func (c *Conn) readBody(b []byte) (int, error) {
+	// Read one more byte than allowed to tell the excess from EOF.
+	max := c.l.MaxRequestBytes
+	remain := max - c.envBytes - atomic.LoadInt64(&c.bodyRead)
+	if max > 0 && int64(len(b)) > remain+1 {
+		b = b[:remain+1]
+	}
+	n, e := c.Conn.Read(b)
+	if max > 0 && int64(n) > remain {
+		n = int(remain)
+		e = errRequestTooLarge
+		atomic.AddInt64(&c.bodyRead, int64(n))
+		c.fail(e)
+		return n, e
 	}
-	if c.err != nil {
-		return 0, c.err
+	// EOF of the body does not fail Write; the peer may shut down only
+	// writing. Nor does the deadline, which http.Server uses to stop the
+	// background read between the requests of a keep-alive connection.
+	if ne, ok := e.(net.Error); e != nil && e != io.EOF && !(ok && ne.Timeout()) {
+		c.setErr(e)
 	}
+	read := atomic.AddInt64(&c.bodyRead, int64(n))
+	if e == io.EOF && read < c.declared && c.l.OnShortBody != nil {
+		c.l.OnShortBody(c, c.declared, read)
+	}
+	return n, e
+}
 
-	// After headers have been read by HTTP server, transfer
-	// socket over to the underlying connection for direct read.
-	if !c.hdrdone {
-		n, e = c.reader.Read(b)
-		if n == 0 || e != nil {
-			c.hdrdone = true
+var _ net.Conn = (*Conn)(nil)
+
+var errRequestTooLarge = errors.New("Invalid uwsgi request; request exceeds MaxRequestBytes")
+
+// ContentLength returns CONTENT_LENGTH of the request, or -1 if unknown.
+func (c *Conn) ContentLength() int64 {
+	c.envMu.RLock()
+	defer c.envMu.RUnlock()
+	return c.declared
+}
+
+// Env returns a copy of the uwsgi vars of the connection, or nil until they
+// are parsed. Unlike Vars, the result may be modified by the caller.
+func (c *Conn) Env() map[string][]string {
+	select {
+	case <-c.readych:
+	default:
+		return nil
+	}
+	c.envMu.RLock()
+	defer c.envMu.RUnlock()
+	env := make(map[string][]string, len(c.env))
+	for k, v := range c.env {
+		env[k] = append([]string(nil), v...)
+	}
+	return env
+}
+
+// request returns the vars of the current request and the time it started.
+func (c *Conn) request() (map[string][]string, time.Time) {
+	c.envMu.RLock()
+	defer c.envMu.RUnlock()
+	return c.env, c.accepted
+}
+
+// BodyBytes returns the number of body bytes read from the connection.
+func (c *Conn) BodyBytes() int64 {
+	return atomic.LoadInt64(&c.bodyRead)
+}
+
+// reject write the error response to the front-end and close the connection.
+func (c *Conn) reject(code int, err error) {
+	fmt.Fprintf(c.Conn, "HTTP/1.0 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+	c.fail(err)
+}
+
+func (c *Conn) setErr(err error) {
+	c.errMu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errMu.Unlock()
+}
+
+func (c *Conn) loadErr() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// signal Read that the vars have been processed. The error must be set before.
+func (c *Conn) signal() {
+	c.signalOnce.Do(func() { close(c.readych) })
+}
+
+// fail close the connection with the error.
+func (c *Conn) fail(err error) {
+	c.Conn.Close()
+	c.setErr(err)
+	c.signal()
+	c.release()
+	if err != io.EOF {
+		c.l.reportError(c.Conn, err)
+	}
+}
+
+func (l *Listener) reportError(conn net.Conn, err error) {
+	if l.ErrorLog != nil {
+		l.ErrorLog.Printf("uwsgi: %v from %s", err, conn.RemoteAddr())
+	}
+	if l.OnError != nil {
+		l.OnError(conn, err)
+	}
+}
+
+func (l *Listener) allowedModifier(m uint8) bool {
+	if len(l.AllowedModifiers) == 0 {
+		return m == ModifierHTTP
+	}
+	return bytes.IndexByte(l.AllowedModifiers, m) >= 0
+}
+
+// isHTTPMethod reports whether b is the head of an HTTP request line, "GET ",
+// "POST" and so on, rather than the uwsgi header.
+func isHTTPMethod(b []byte) bool {
+	for _, c := range b {
+		if (c < 'A' || c > 'Z') && c != ' ' {
+			return false
 		}
 	}
-	if c.hdrdone {
-		n, e = c.Conn.Read(b)
-		c.err = e
+	return b[0] != ' '
+}
+
+// setHeaderDeadline set the read deadline t for the uwsgi packet. The zero t
+// restores the deadline of the server.
+func (c *Conn) setHeaderDeadline(t time.Time) {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if t.IsZero() {
+		t = earlier(c.readDeadline, c.reqRead)
 	}
+	c.Conn.SetReadDeadline(t)
+}
 
-	return n, e
+// setRequestDeadline set the deadline t of Listener.RequestTimeout for the
+// body and the response. The zero t clears it.
+func (c *Conn) setRequestDeadline(t time.Time) {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.reqRead, c.reqWrite = t, t
+	c.Conn.SetReadDeadline(earlier(c.readDeadline, t))
+	c.Conn.SetWriteDeadline(earlier(c.writeDeadline, t))
+}
+
+// clearReadRequestDeadline clear the read deadline of
+// Listener.RequestTimeout, before the next packet of Listener.KeepAlive.
+// The response of the previous request is still bounded.
+func (c *Conn) clearReadRequestDeadline() {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if c.reqRead.IsZero() {
+		return
+	}
+	c.reqRead = time.Time{}
+	c.Conn.SetReadDeadline(c.readDeadline)
+}
+
+// earlier returns the earlier deadline of a and b, where zero means none.
+func earlier(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// Close close the connection and release the slot of Listener.MaxConns.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if m, ok := c.l.Metrics.(RequestMetrics); ok {
+			c.observe(m)
+		}
+	})
+	c.release()
+	if c.tunneled {
+		return nil
+	}
+	return c.Conn.Close()
 }
 
 // Writer behave as same as net.Listener
 func (c *Conn) Write(b []byte) (int, error) {
-	if c.err != nil {
-		return 0, c.err
+	if err := c.loadErr(); err != nil {
+		return 0, err
 	}
 
-	return c.Conn.Write(b)
+	n, err := c.Conn.Write(b)
+	if c.l.Metrics != nil {
+		atomic.AddInt64(&c.written, int64(n))
+	}
+	return n, err
 }
 
 // SetDeadline behave as same as net.Listener
 func (c *Conn) SetDeadline(t time.Time) error {
-	if c.err != nil {
-		return c.err
+	if err := c.loadErr(); err != nil {
+		return err
 	}
 
-	return c.Conn.SetDeadline(t)
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.notifyDeadline()
+	if err := c.Conn.SetReadDeadline(earlier(t, c.reqRead)); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(earlier(t, c.reqWrite))
 }
 
 // SetReadDeadline behave as same as net.Listener
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	if c.err != nil {
-		return c.err
+	if err := c.loadErr(); err != nil {
+		return err
 	}
 
-	return c.Conn.SetReadDeadline(t)
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	c.notifyDeadline()
+	return c.Conn.SetReadDeadline(earlier(t, c.reqRead))
+}
+
+func (c *Conn) notifyDeadline() {
+	select {
+	case c.deadlinech <- struct{}{}:
+	default:
+	}
 }
 
 // SetWriteDeadline behave as same as net.Listener
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	if c.err != nil {
-		return c.err
+	if err := c.loadErr(); err != nil {
+		return err
 	}
 
-	return c.Conn.SetWriteDeadline(t)
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(earlier(t, c.reqWrite))
 }
 
+// headerMappings map the vars without HTTP_ prefix to header names. The vars
+// with HTTP_ prefix are converted by the CGI rule; see appendHeaderName.
 var headerMappings = map[string]string{
-	"HTTP_HOST":              "Host",
-	"CONTENT_TYPE":           "Content-Type",
-	"HTTP_ACCEPT":            "Accept",
-	"HTTP_ACCEPT_ENCODING":   "Accept-Encoding",
-	"HTTP_ACCEPT_LANGUAGE":   "Accept-Language",
-	"HTTP_ACCEPT_CHARSET":    "Accept-Charset",
-	"HTTP_CONTENT_TYPE":      "Content-Type",
-	"HTTP_COOKIE":            "Cookie",
-	"HTTP_IF_MATCH":          "If-Match",
-	"HTTP_IF_MODIFIED_SINCE": "If-Modified-Since",
-	"HTTP_IF_NONE_MATCH":     "If-None-Match",
-	"HTTP_IF_RANGE":          "If-Range",
-	"HTTP_RANGE":             "Range",
-	"HTTP_REFERER":           "Referer",
-	"HTTP_USER_AGENT":        "User-Agent",
-	"HTTP_X_REQUESTED_WITH":  "Requested-With",
+	"CONTENT_TYPE": "Content-Type",
+}
+
+// singletonVars are the vars of the headers which must appear once by RFC
+// 9110. Only the first value is written. Cookie is merged with "; " instead,
+// and the other headers are list-valued and may repeat.
+var singletonVars = map[string]bool{
+	"HTTP_AUTHORIZATION":       true,
+	"HTTP_PROXY_AUTHORIZATION": true,
+	"HTTP_USER_AGENT":          true,
+	"HTTP_REFERER":             true,
+	"HTTP_FROM":                true,
+	"HTTP_MAX_FORWARDS":        true,
+	"HTTP_IF_MODIFIED_SINCE":   true,
+	"HTTP_IF_UNMODIFIED_SINCE": true,
+	"HTTP_IF_RANGE":            true,
+	"HTTP_RANGE":               true,
 }
 
 // Accept conduct as net.Listener. uWSGI protocol is working good for CGI.
@@ -131,220 +736,1027 @@ func (l *Listener) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	for !l.allowedPeer(fd.RemoteAddr()) {
+		fd.Close()
+		if fd, err = l.Listener.Accept(); err != nil {
+			return nil, err
+		}
+	}
 
-	buf := new(bytes.Buffer)
-	c := &Conn{fd, make(map[string][]string), buf, false, false, make(chan bool, 1), nil}
+	c := &Conn{
+		Conn:       fd,
+		l:          l,
+		accepted:   time.Now(),
+		readych:    make(chan struct{}),
+		closed:     make(chan struct{}),
+		deadlinech: make(chan struct{}, 1),
+	}
+	if !l.track(c) {
+		fd.Close()
+		return nil, net.ErrClosed
+	}
+	if _, ok := fd.(*net.UnixConn); ok {
+		c.peerCred, _ = peerCred(fd)
+	}
 
-	go func() {
-		/*
-		 * uwsgi header:
-		 * struct {
-		 *    uint8  modifier1;
-		 *    uint16 datasize;
-		 *    uint8  modifier2;
-		 * }
-		 *  -- for HTTP, mod1 and mod2 = 0
-		 */
-		var head [4]byte
-		fd.Read(head[:])
-		b := []byte{head[1], head[2]}
-		envsize := binary.LittleEndian.Uint16(b)
-
-		envbuf := make([]byte, envsize)
-		if _, err := io.ReadFull(fd, envbuf); err != nil {
-			fd.Close()
-			c.err = err
+	if l.InlineParse {
+		c.inline = true
+	} else {
+		go c.parse()
+	}
+
+	return c, nil
+}
+
+// parse read the uwsgi packet and build the HTTP request from the vars.
+// Once finished, Read can continue.
+func (c *Conn) parse() {
+	/*
+	 * uwsgi header:
+	 * struct {
+	 *    uint8  modifier1;
+	 *    uint16 datasize;
+	 *    uint8  modifier2;
+	 * }
+	 *  -- for HTTP, mod1 and mod2 = 0
+	 */
+	l := c.l
+	if !l.admit(c) {
+		return
+	}
+
+	if l.HeaderTimeout > 0 {
+		c.setHeaderDeadline(time.Now().Add(l.HeaderTimeout))
+	}
+
+	var head [4]byte
+	if n, err := io.ReadFull(c.Conn, head[:]); n == 0 {
+		// The peer sent nothing, e.g. port scanners and health checks.
+		// This is not an error of the request.
+		c.fail(io.EOF)
+		return
+	} else if err != nil {
+		c.fail(err)
+		return
+	}
+	if l.FallbackHandler != nil && isHTTPMethod(head[:]) {
+		// Raw HTTP from a direct client. The bytes read are given back to
+		// the HTTP server.
+		if l.HeaderTimeout > 0 {
+			c.setHeaderDeadline(time.Time{})
+		}
+		c.raw = true
+		c.envMu.Lock()
+		c.declared = -1
+		c.envBytes = int64(len(head))
+		c.envMu.Unlock()
+		c.reader = bytes.NewReader(head[:])
+		c.signal()
+		return
+	}
+	order := l.ByteOrder
+	if order == nil {
+		order = binary.LittleEndian
+	}
+	envsize := order.Uint16(head[1:3])
+	if l.MaxEnvSize > 0 && envsize > l.MaxEnvSize {
+		// Rejected before the buffer is allocated.
+		c.fail(fmt.Errorf("Invalid uwsgi request; datasize %d exceeds MaxEnvSize %d", envsize, l.MaxEnvSize))
+		return
+	}
+	if h := l.packetHandler(head[0]); h != nil {
+		payload := make([]byte, envsize)
+		if _, err := io.ReadFull(c.Conn, payload); err != nil {
+			c.fail(err)
 			return
 		}
-
-		/*
-		 * uwsgi vars are linear lists of the form:
-		 * struct {
-		 *   uint16 key_size;
-		 *   uint8  key[key_size];
-		 *   uint16 val_size;
-		 *   uint8  val[val_size];
-		 * }
-		 */
-		i := uint16(0)
-		var reqMethod string
-		var reqURI string
-		var reqProtocol string
-		for {
-			// Ensure no corrupted payload; shouldn't happen but it has...
-			if i+1 >= uint16(len(envbuf)) {
-				break
+		if l.HeaderTimeout > 0 {
+			c.setHeaderDeadline(time.Time{})
+		}
+		c.tunneled = true
+		c.setErr(io.EOF)
+		c.signal()
+		c.release()
+		h.ServePacket(c.Conn, head[0], head[3], payload)
+		return
+	}
+	if head[0] == ModifierPing && !l.DisablePing {
+		// The empty response means the worker is alive.
+		c.Conn.Write([]byte{ModifierPing, 0, 0, 0})
+		c.fail(io.EOF)
+		return
+	}
+	if !l.allowedModifier(head[0]) {
+		err := fmt.Errorf("Invalid uwsgi request; modifier1 %d is not allowed", head[0])
+		switch l.UnsupportedModifierAction {
+		case ModifierLog:
+			// ErrorLog, if set, logs it in fail.
+			if l.ErrorLog == nil {
+				log.Printf("uwsgi: %v from %s", err, c.Conn.RemoteAddr())
 			}
-			b := []byte{envbuf[i], envbuf[i+1]}
-			kl := binary.LittleEndian.Uint16(b)
-			i += 2
+		case ModifierRespond:
+			msg := fmt.Sprintf("Unsupported uwsgi modifier1 %d\n", head[0])
+			fmt.Fprintf(c.Conn, "HTTP/1.0 400 Bad Request\r\nConnection: close\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s", len(msg), msg)
+		}
+		c.fail(err)
+		return
+	}
+	env, err := Decoder{LengthSize: l.LengthSize, ByteOrder: order}.readVars(c.Conn, int(envsize))
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if l.HeaderTimeout > 0 {
+		c.setHeaderDeadline(time.Time{})
+	}
+	c.prepare(env, int64(len(head)+int(envsize)), c.accepted, head[0], head[3])
+}
 
-			if i+kl > uint16(len(envbuf)) {
-				fd.Close()
-				c.err = errors.New("Invalid uwsgi request; uwsgi vars index out of range")
-				return
-			}
+// prepare build the HTTP request from the vars of the packet of size bytes,
+// and signal Read. started is the time the request started, and modifier1
+// and modifier2 are the ones of the packet.
+func (c *Conn) prepare(env map[string][]string, size int64, started time.Time, modifier1, modifier2 uint8) {
+	l := c.l
+	if _, ok := env["SERVER_PROTOCOL"]; ok {
+		env["SERVER_PROTOCOL"] = []string{"HTTP/1.0"}
+	}
+	// The body without length is framed by Conn.Read.
+	if l.UnboundedBody && unboundedBody(env) {
+		env["HTTP_TRANSFER_ENCODING"] = []string{"chunked"}
+		c.chunked = &chunkedBody{c: c}
+	}
+	declared := int64(-1)
+	if v, ok := env["CONTENT_LENGTH"]; ok {
+		if cl, err := strconv.ParseInt(v[0], 10, 64); err == nil {
+			declared = cl
+		}
+	}
+	c.last = hasVar(env, "HTTP_TRANSFER_ENCODING")
+	c.envMu.Lock()
+	c.env = env
+	c.accepted = started
+	c.modifier1, c.modifier2 = modifier1, modifier2
+	c.envBytes = size
+	c.declared = declared
+	c.envMu.Unlock()
 
-			k := string(envbuf[i : i+kl])
-			i += kl
+	if max := l.MaxRequestBytes; max > 0 && (c.envBytes > max || c.envBytes+c.declared > max) {
+		c.reject(http.StatusRequestEntityTooLarge, errRequestTooLarge)
+		return
+	}
+	if !l.admitPeer(c) {
+		c.reject(http.StatusServiceUnavailable, errors.New("Too many connections from "+c.env["REMOTE_ADDR"][0]))
+		return
+	}
 
-			if i+1 >= uint16(len(envbuf)) {
-				fd.Close()
-				c.err = errors.New("Invalid uwsgi request; uwsgi vars index out of range")
-				return
-			}
+	if v, ok := env["REQUEST_METHOD"]; ok && v[0] == "CONNECT" && l.TunnelHandler != nil {
+		// Detach the connection from the HTTP server, which sees EOF.
+		c.tunneled = true
+		c.setErr(io.EOF)
+		c.signal()
+		c.release()
+		l.TunnelHandler(c.Conn, env)
+		return
+	}
+	if l.RequestTimeout > 0 {
+		c.setRequestDeadline(time.Now().Add(l.RequestTimeout))
+	}
 
-			b = []byte{envbuf[i], envbuf[i+1]}
-			vl := binary.LittleEndian.Uint16(b)
-			i += 2
+	hb := getBuf(int(size) + 64)
+	hdr, code, err := l.buildRequest(*hb, c.env)
+	if err != nil {
+		putBuf(hb)
+		if code != 0 {
+			c.reject(code, err)
+		} else {
+			c.fail(err)
+		}
+		return
+	}
+	*hb = hdr
+	c.hdrbuf = hb
+	c.hdrReader.Reset(hdr)
+	c.reader = &c.hdrReader
 
-			if i+vl > uint16(len(envbuf)) {
-				fd.Close()
-				c.err = errors.New("Invalid uwsgi request; uwsgi vars index out of range")
-				return
-			}
+	if l.DebugWriter != nil {
+		l.debug(hdr, c.env)
+	}
 
-			v := string(envbuf[i : i+vl])
-			i += vl
+	// Signal to indicate header processing is complete and remaining
+	// payload can be read from the socket itself.
+	c.signal()
+}
 
-			if k == "REQUEST_METHOD" {
-				reqMethod = v
-			} else if k == "REQUEST_URI" {
-				reqURI = v
-			} else if k == "SERVER_PROTOCOL" {
-				v = "HTTP/1.0"
-				reqProtocol = v
-			}
+// buildRequest reconstruct the HTTP request line and headers from the uwsgi
+// vars, appended to buf. REQUEST_URI is put on the request line as is, still
+// percent-encoded as the client sent, so net/http decodes it once and keeps
+// e.g. %2F in URL.RawPath. PATH_INFO, decoded by the front-end, is used only
+// without REQUEST_URI or by URIFromPathInfo. If the request should be
+// rejected with an HTTP response, the status code is returned with the
+// error.
+func (l *Listener) buildRequest(buf []byte, env map[string][]string) ([]byte, int, error) {
+	var reqMethod, reqURI, reqProtocol string
+	if v, ok := env["REQUEST_METHOD"]; ok {
+		reqMethod = v[0]
+	}
+	if v, ok := env["REQUEST_URI"]; ok {
+		reqURI = v[0]
+	}
+	if v, ok := env["SERVER_PROTOCOL"]; ok {
+		reqProtocol = v[0]
+	}
 
-			val, ok := c.env[k]
-			if !ok {
-				val = make([]string, 0, 2)
-			}
-			val = append(val, v)
-			c.env[k] = val
+	if reqProtocol == "" {
+		// Invalid protocol
+		return nil, 0, errors.New("Invalid uwsgi request; no protocol specified")
+	}
+	// The method is not defaulted; the packet without it is broken rather
+	// than a GET request. REQUEST_URI is optional, see below.
+	if reqMethod == "" {
+		return nil, 0, errors.New("Invalid uwsgi request; no method specified")
+	}
+	if !validMethod(reqMethod) {
+		return nil, http.StatusBadRequest, errors.New("Invalid uwsgi request; malformed REQUEST_METHOD")
+	}
 
-			if i >= envsize {
-				break
-			}
+	// Without REQUEST_URI, the path is reconstructed as CGI does. The app
+	// mounted at root has empty SCRIPT_NAME and the full path in PATH_INFO.
+	if (reqURI == "" || l.URIFromPathInfo) && (hasVar(env, "SCRIPT_NAME") || hasVar(env, "PATH_INFO")) {
+		u := url.URL{Path: firstVar(env, "PATH_INFO")}
+		if !l.StripScriptName {
+			u.Path = firstVar(env, "SCRIPT_NAME") + u.Path
 		}
+		u.RawQuery = firstVar(env, "QUERY_STRING")
+		reqURI = u.RequestURI()
+	} else if l.StripScriptName {
+		reqURI = stripScriptName(reqURI, firstVar(env, "SCRIPT_NAME"))
+	}
 
-		if reqProtocol == "" {
-			// Invalid protocol
-			fd.Close()
-			c.err = errors.New("Invalid uwsgi request; no protocol specified")
-			return
+	// Empty or query-only URI is not valid on the request line.
+	switch {
+	case reqURI == "":
+		reqURI = "/"
+	case reqURI[0] == '?':
+		reqURI = "/" + reqURI
+	}
+
+	if !validRequestURI(reqURI) {
+		return nil, http.StatusBadRequest, errors.New("Invalid uwsgi request; malformed REQUEST_URI")
+	}
+
+	// The request which has both Content-Length and Transfer-Encoding is
+	// ambiguous, and can be used for request smuggling.
+	if hasVar(env, "CONTENT_LENGTH") || hasVar(env, "HTTP_CONTENT_LENGTH") {
+		if hasVar(env, "HTTP_TRANSFER_ENCODING") {
+			return nil, http.StatusBadRequest, errors.New("Invalid uwsgi request; both Content-Length and Transfer-Encoding are specified")
 		}
+	}
 
-		fmt.Fprintf(buf, "%s %s %s\r\n", reqMethod, reqURI, reqProtocol)
+	// Absolute-form URI from forward proxies is turned into origin-form,
+	// and its authority is used as Host.
+	var reqHost string
+	if !strings.HasPrefix(reqURI, "/") {
+		if u, err := url.ParseRequestURI(reqURI); err == nil && u.Host != "" {
+			reqURI = u.RequestURI()
+			reqHost = u.Host
+		}
+	}
+	if _, err := url.ParseRequestURI(reqURI); err != nil {
+		return nil, http.StatusBadRequest, errors.New("Invalid uwsgi request; malformed REQUEST_URI")
+	}
+
+	// HTTP/1.1 requires Host.
+	if reqHost == "" {
+		switch {
+		case hasVar(env, "HTTP_HOST"):
+			reqHost = env["HTTP_HOST"][0]
+		case hasVar(env, "HOST"):
+			// Not standard, but some clients send it.
+			reqHost = env["HOST"][0]
+		case hasVar(env, "SERVER_NAME"):
+			reqHost = env["SERVER_NAME"][0]
+			if port := env["SERVER_PORT"]; len(port) > 0 && port[0] != "" && port[0] != "80" && port[0] != "443" {
+				reqHost = net.JoinHostPort(reqHost, port[0])
+			}
+		case l.DefaultHost != "":
+			reqHost = l.DefaultHost
+		default:
+			return nil, http.StatusBadRequest, errors.New("Invalid uwsgi request; no host specified")
+		}
+	}
 
-		var cl int64
-		for i := range c.env {
-			switch i {
-			case "CONTENT_LENGTH":
-				cl, _ = strconv.ParseInt(c.env[i][0], 10, 64)
-				if cl > 0 {
-					fmt.Fprintf(buf, "Content-Length: %d\r\n", cl)
+	// http.Server ignores Transfer-Encoding of HTTP/1.0 requests, so the
+	// chunked body needs HTTP/1.1. The response of unknown length is
+	// chunked then.
+	if v := env["HTTP_TRANSFER_ENCODING"]; len(v) > 0 && strings.EqualFold(v[0], "chunked") {
+		reqProtocol = "HTTP/1.1"
+	}
+
+	buf = append(buf, reqMethod...)
+	buf = append(buf, ' ')
+	buf = append(buf, reqURI...)
+	buf = append(buf, ' ')
+	buf = append(buf, reqProtocol...)
+	buf = append(buf, "\r\n"...)
+	mark := len(buf)
+	buf = appendHeader(buf, "Host", reqHost)
+
+	// The headers are written in the order of the names, so the same
+	// vars always make the same header block.
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	// MaxHeaders counts the lines written, after the mapping and the
+	// merge of the vars.
+	lines := 0
+	for _, i := range names {
+		if l.MaxHeaders > 0 {
+			lines += bytes.Count(buf[mark:], crlf)
+			mark = len(buf)
+			if lines > l.MaxHeaders {
+				return nil, http.StatusRequestHeaderFieldsTooLarge, errTooManyHeaders
+			}
+		}
+		switch i {
+		case "CONTENT_LENGTH":
+			// Zero is written too, so the empty body is distinguished
+			// from the unknown length.
+			if cl, err := strconv.ParseInt(env[i][0], 10, 64); err == nil && cl >= 0 {
+				buf = append(buf, "Content-Length: "...)
+				buf = strconv.AppendInt(buf, cl, 10)
+				buf = append(buf, "\r\n"...)
+			}
+		case "CONTENT_TYPE", "HTTP_CONTENT_TYPE":
+			// Content-Type must be single. CONTENT_TYPE which is
+			// the CGI standard wins over HTTP_CONTENT_TYPE, unless
+			// it is empty as nginx sends for the requests without
+			// body.
+			if i != "CONTENT_TYPE" && hasVar(env, "CONTENT_TYPE") {
+				continue
+			}
+			if !hasVar(env, i) {
+				continue
+			}
+			buf = appendHeader(buf, "Content-Type", env[i][0])
+		case "HTTP_CONTENT_LENGTH":
+			// CONTENT_LENGTH wins over HTTP_CONTENT_LENGTH.
+			if _, ok := env["CONTENT_LENGTH"]; ok {
+				continue
+			}
+			if cl, err := strconv.ParseInt(env[i][0], 10, 64); err == nil && cl >= 0 {
+				buf = append(buf, "Content-Length: "...)
+				buf = strconv.AppendInt(buf, cl, 10)
+				buf = append(buf, "\r\n"...)
+			}
+		case "HTTP_HOST":
+			// Already written.
+		case "HTTP_COOKIE":
+			// Cookie must be a single line, so the values are merged.
+			buf = appendHeader(buf, "Cookie", strings.Join(env[i], "; "))
+		case "HTTP_CONNECTION":
+			if l.KeepAlive && !hasVar(env, "HTTP_TRANSFER_ENCODING") {
+				for _, v := range env[i] {
+					buf = appendHeader(buf, "Connection", v)
 				}
-			default:
-				hname, ok := headerMappings[i]
-				if !ok {
-					// To avoid double Host headers in some cases, only parse HTTP_HOST as a correct Host.
-					if i == "Host" {
-						continue
+			}
+		default:
+			if hname, ok := l.HeaderMap[i]; ok {
+				for _, v := range env[i] {
+					if hname != "" {
+						buf = appendHeader(buf, hname, v)
 					}
-					hname = i
 				}
-				for v := range c.env[i] {
-					fmt.Fprintf(buf, "%s: %s\r\n", hname, c.env[i][v])
+				continue
+			}
+			// Fast path for the most of the vars.
+			if strings.HasPrefix(i, "HTTP_") {
+				values := env[i]
+				if len(values) > 1 && singletonVars[i] {
+					values = values[:1]
+				}
+				for _, v := range values {
+					buf = appendHeaderName(buf, i[5:])
+					buf = append(buf, ": "...)
+					buf = append(buf, v...)
+					buf = append(buf, "\r\n"...)
+				}
+				continue
+			}
+			hname, ok := headerMappings[i]
+			if !ok {
+				// To avoid double Host headers in some cases, only parse HTTP_HOST as a correct Host.
+				if strings.EqualFold(i, "Host") {
+					continue
 				}
+				hname = i
+			}
+			for _, v := range env[i] {
+				buf = appendHeader(buf, hname, v)
 			}
 		}
+	}
 
-		buf.Write([]byte("\r\n"))
+	// The request whose body is not framed by the length is the last one;
+	// Conn can't find the next packet after it.
+	switch {
+	case !l.KeepAlive || hasVar(env, "HTTP_TRANSFER_ENCODING"):
+		buf = append(buf, "Connection: close\r\n"...)
+	case !hasVar(env, "HTTP_CONNECTION"):
+		buf = append(buf, "Connection: keep-alive\r\n"...)
+	}
+	if l.MaxHeaders > 0 && lines+bytes.Count(buf[mark:], crlf) > l.MaxHeaders {
+		return nil, http.StatusRequestHeaderFieldsTooLarge, errTooManyHeaders
+	}
+	buf = append(buf, "\r\n"...)
+	return buf, 0, nil
+}
 
-		// Signal to indicate header processing is complete and remaining
-		// payload can be read from the socket itself.
-		c.readych <- true
-	}()
+var (
+	crlf              = []byte("\r\n")
+	errTooManyHeaders = errors.New("Invalid uwsgi request; too many headers")
+)
 
-	return c, nil
+// stripScriptName remove the mount point from the request URI at the segment
+// boundary. The URI outside of the mount point is returned as is.
+func stripScriptName(uri, scriptName string) string {
+	scriptName = strings.TrimSuffix(scriptName, "/")
+	if scriptName == "" || !strings.HasPrefix(uri, scriptName) {
+		return uri
+	}
+	rest := uri[len(scriptName):]
+	if rest != "" && rest[0] != '/' && rest[0] != '?' {
+		return uri
+	}
+	return rest
+}
+
+// hasVar reports whether the var is present and not empty.
+func hasVar(env map[string][]string, k string) bool {
+	v, ok := env[k]
+	return ok && v[0] != ""
 }
 
+// validRequestURI reports whether the URI can be put on the request line as
+// is: no spaces, control characters nor fragment, and well-formed
+// percent-encoding.
+func validRequestURI(uri string) bool {
+	for i := 0; i < len(uri); i++ {
+		switch b := uri[i]; {
+		case b <= ' ' || b == 0x7f || b == '#':
+			return false
+		case b == '%':
+			if i+2 >= len(uri) || !isHex(uri[i+1]) || !isHex(uri[i+2]) {
+				return false
+			}
+			i += 2
+		}
+	}
+	return true
+}
+
+// validMethod reports whether the method is a token of RFC 9110.
+func validMethod(method string) bool {
+	for i := 0; i < len(method); i++ {
+		b := method[i]
+		if b <= ' ' || b >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, b) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func firstVar(env map[string][]string, k string) string {
+	if v := env[k]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func isHex(b byte) bool {
+	return '0' <= b && b <= '9' || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F'
+}
+
+// appendHeaderName append the canonical header name of the var without
+// HTTP_ prefix. e.g. X_FORWARDED_FOR is appended as X-Forwarded-For.
+func appendHeaderName(buf []byte, name string) []byte {
+	start := len(buf)
+	buf = append(buf, name...)
+	upper := true
+	for i := start; i < len(buf); i++ {
+		switch b := buf[i]; {
+		case b == '_':
+			buf[i] = '-'
+			upper = true
+		case upper:
+			if 'a' <= b && b <= 'z' {
+				buf[i] = b - ('a' - 'A')
+			}
+			upper = false
+		case 'A' <= b && b <= 'Z':
+			buf[i] = b + ('a' - 'A')
+		}
+	}
+	return buf
+}
+
+func appendHeader(buf []byte, name, value string) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, ": "...)
+	buf = append(buf, value...)
+	return append(buf, "\r\n"...)
+}
+
+// debug write the reconstructed header block and the var names.
+func (l *Listener) debug(hdr []byte, env map[string][]string) {
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	b.Write(hdr)
+	fmt.Fprintf(&b, "# %d uwsgi vars: %s\n", len(names), strings.Join(names, ", "))
+
+	l.debugMu.Lock()
+	defer l.debugMu.Unlock()
+	l.DebugWriter.Write(b.Bytes())
+}
+
+// DefaultServerSoftware is SERVER_SOFTWARE sent by Passenger and Transport.
+const DefaultServerSoftware = "go-uwsgi"
+
 // Passenger works as uWSGI transport
 type Passenger struct {
 	Net  string
 	Addr string
-}
 
-var trailingPort = regexp.MustCompile(`:([0-9]+)$`)
+	// ExpectContinueTimeout is the time to wait for the interim response
+	// from the backend before sending the body of the request which has
+	// "Expect: 100-continue". Zero means one second.
+	ExpectContinueTimeout time.Duration
+
+	// MaxIdleConns is the maximum number of idle connections kept for
+	// reuse. The connections are shared by Passengers which have same Net
+	// and Addr. Zero means the connection is closed after each request,
+	// which is the behavior expected by most of uwsgi backends. The request
+	// without body is retried on a new connection if the idle one fails
+	// before the response; see also CloseIdleConnections. The connections
+	// are shared only by the Passengers which have the same TLSConfig too,
+	// and are not pooled with Dial, which can't be told apart.
+	MaxIdleConns int
+
+	// IdleTimeout is the maximum time an idle connection is kept. Zero
+	// means 90 seconds.
+	IdleTimeout time.Duration
+
+	// MaxConnLifetime is the maximum time a connection is reused since it
+	// was dialed, e.g. to follow the backends behind DNS or a balancer.
+	// Zero means no limit.
+	MaxConnLifetime time.Duration
+
+	// ServerProtocol, if not empty, is sent as SERVER_PROTOCOL instead of
+	// the protocol of the request. HTTP/2 and later are sent as HTTP/1.1
+	// by default because many uwsgi backends don't know them.
+	ServerProtocol string
+
+	// ServerSoftware, if not empty, is sent as SERVER_SOFTWARE instead of
+	// DefaultServerSoftware, for the backends which log it.
+	ServerSoftware string
+
+	// DialTimeout is the timeout to connect to the backend. Zero means 30
+	// seconds. The dial and the exchange are aborted also when the request
+	// is canceled.
+	DialTimeout time.Duration
+
+	// Dial, if not nil, connects to the backend instead of net.Dialer, e.g.
+	// through a proxy or to an in-memory backend for tests. It is called
+	// with Net and Addr; DialTimeout is not applied to it.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// TLSConfig, if not nil, wraps the connection to the backend in TLS,
+	// for the backend which serves uwsgi over TLS. ServerName defaults to
+	// the host of Addr. The failure of the handshake is answered with 502.
+	TLSConfig *tls.Config
+
+	// TrustForwardedHeaders send the left-most address of X-Forwarded-For
+	// as REMOTE_ADDR and REMOTE_HOST, i.e. the original client behind the
+	// proxies in front of Passenger. Set this only if they are trusted; the
+	// client can send any X-Forwarded-For. Either way, the address of the
+	// peer is appended to HTTP_X_FORWARDED_FOR.
+	TrustForwardedHeaders bool
+
+	// ScriptName is the mount point of the backend application, sent as
+	// SCRIPT_NAME. PATH_INFO is the path beyond it. The request outside of
+	// it is sent with empty SCRIPT_NAME and the full path.
+	ScriptName string
+
+	// Modifier1 and Modifier2 are sent in the header of the packet. Zero,
+	// which is ModifierHTTP, is for WSGI and most of the other handlers.
+	Modifier1 uint8
+	Modifier2 uint8
+
+	// Metrics, if not nil, observes each request after its response is
+	// relayed. See RequestMetrics.
+	Metrics RequestMetrics
+}
 
 func (p Passenger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	conn, err := net.Dial(p.Net, p.Addr)
+	var stats exchangeStats
+	if p.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			p.Metrics.ObserveRequest(req.Method, req.URL.RequestURI(), time.Since(start),
+				stats.packet+atomic.LoadInt64(&stats.body), stats.resp)
+		}()
+	}
+
+	vars := requestVars(req)
+	mountVars(vars, p.ScriptName, req.URL.Path)
+	forwardedVars(vars, req, p.TrustForwardedHeaders)
+	if p.ServerProtocol != "" {
+		vars["SERVER_PROTOCOL"] = []string{p.ServerProtocol}
+	}
+	if p.ServerSoftware != "" {
+		vars["SERVER_SOFTWARE"] = []string{p.ServerSoftware}
+	}
+	// The request which can't be framed, e.g. by huge cookies, fails
+	// before the backend is dialed.
+	if _, err := varsSize(vars); err != nil {
+		badGateway(w)
+		return
+	}
+
+	var pool *connPool
+	if p.MaxIdleConns > 0 && p.Dial == nil {
+		pool = getConnPool(p.poolKey())
+		if conn := pool.get(p.idleTimeout(), p.MaxConnLifetime); conn != nil {
+			// The backend may have closed the idle connection. The
+			// request without body is retried once on a new one.
+			if !p.exchange(w, req, vars, conn, pool, &stats) {
+				return
+			}
+			if (req.Body != nil && req.Body != http.NoBody) || req.Context().Err() != nil {
+				badGateway(w)
+				return
+			}
+		}
+	}
+
+	conn, err := p.dial(req.Context())
+	if err != nil {
+		badGateway(w)
+		return
+	}
+	if pool != nil {
+		conn = &pooledConn{Conn: conn, dialed: time.Now()}
+	}
+	if p.exchange(w, req, vars, conn, pool, &stats) {
+		badGateway(w)
+	}
+}
+
+func (p Passenger) dial(ctx context.Context) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if p.Dial != nil {
+		conn, err = p.Dial(p.Net, p.Addr)
+	} else {
+		timeout := p.DialTimeout
+		if timeout == 0 {
+			timeout = 30 * time.Second
+		}
+		d := net.Dialer{Timeout: timeout}
+		conn, err = d.DialContext(ctx, p.Net, p.Addr)
+	}
+	if err != nil || p.TLSConfig == nil {
+		return conn, err
+	}
+
+	config := p.TLSConfig
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _ = splitHostPort(p.Addr)
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+func (p Passenger) idleTimeout() time.Duration {
+	if p.IdleTimeout == 0 {
+		return 90 * time.Second
+	}
+	return p.IdleTimeout
+}
+
+// CloseIdleConnections close the idle connections to the backend, which are
+// kept by MaxIdleConns.
+func (p Passenger) CloseIdleConnections() {
+	if v, ok := connPools.Load(p.poolKey()); ok {
+		v.(*connPool).closeIdle()
+	}
+}
+
+func (p Passenger) poolKey() poolKey {
+	return poolKey{network: p.Net, addr: p.Addr, tls: p.TLSConfig}
+}
+
+// exchange send the request on conn and relay the response to w. It
+// returns true, without writing to w, if the exchange failed before any byte
+// of the response; the caller may retry then.
+func (p Passenger) exchange(w http.ResponseWriter, req *http.Request, vars map[string][]string, conn net.Conn, pool *connPool, stats *exchangeStats) (retry bool) {
+	reuse := false
+	var bodyDone chan error
+	stop := watchContext(req.Context(), conn)
+	defer func() {
+		if stop() && reuse {
+			pool.put(conn, p.MaxIdleConns)
+			return
+		}
+		conn.Close()
+		// The body must not be read after ServeHTTP returns. The copy
+		// stops by the closed connection.
+		if bodyDone != nil {
+			<-bodyDone
+		}
+	}()
+
+	if err := WritePacket(conn, p.Modifier1, p.Modifier2, vars); err != nil {
+		return true
+	}
+	size, _ := varsSize(vars)
+	stats.packet = int64(4 + size)
+
+	// The body is sent concurrently so the interim responses can be relayed
+	// while the backend is waiting for it. When the client expects
+	// 100-continue, the body is held until the backend answers.
+	expect := strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+	sendBody := make(chan bool, 1)
+	bodyDone = make(chan error, 1)
+	go func() {
+		if expect {
+			timeout := p.ExpectContinueTimeout
+			if timeout == 0 {
+				timeout = time.Second
+			}
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case send := <-sendBody:
+				if !send {
+					bodyDone <- errors.New("body is not sent")
+					return
+				}
+			case <-timer.C:
+			}
+		}
+		n, err := io.Copy(conn, req.Body)
+		atomic.StoreInt64(&stats.body, n)
+		bodyDone <- err
+	}()
+
+	cr := &countReader{r: conn}
+	defer func() { stats.resp = cr.n }()
+	br := bufio.NewReader(cr)
+	res, err := http.ReadResponse(br, req)
+	for err == nil && res.StatusCode >= 100 && res.StatusCode < 200 && res.StatusCode != http.StatusSwitchingProtocols {
+		if res.StatusCode == http.StatusContinue {
+			select {
+			case sendBody <- true:
+			default:
+			}
+		}
+		for k, v := range res.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(res.StatusCode)
+		for k := range res.Header {
+			w.Header().Del(k)
+		}
+		res, err = http.ReadResponse(br, req)
+	}
+	select {
+	case sendBody <- false:
+	default:
+	}
 	if err != nil {
-		panic(err.Error())
+		if cr.n == 0 {
+			return true
+		}
+		badGateway(w)
+		return false
+	}
+	for k, v := range res.Header {
+		w.Header().Del(k)
+		for _, vv := range v {
+			w.Header().Add(k, vv)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	if err := copyResponse(w, res.Body); err != nil || pool == nil {
+		return false
 	}
-	defer conn.Close()
 
-	port := "80"
-	if matches := trailingPort.FindStringSubmatch(req.Host); len(matches) != 0 {
-		port = matches[1]
+	// The connection can be reused only when the whole exchange finished
+	// in the framing and the backend doesn't close the connection.
+	chunked := len(res.TransferEncoding) > 0 && res.TransferEncoding[0] == "chunked"
+	if res.Close || (res.ContentLength < 0 && !chunked) || br.Buffered() > 0 {
+		return false
+	}
+	// The backend may answer before the body is written completely.
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	select {
+	case err := <-bodyDone:
+		bodyDone = nil
+		reuse = err == nil
+	case <-timer.C:
+	}
+	return false
+}
+
+// countReader counts the bytes read.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// copyResponse copy the body of the backend to w. Each read is flushed, so
+// server-sent events and long responses are streamed to the client.
+func copyResponse(w http.ResponseWriter, body io.Reader) error {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		_, err := io.Copy(w, body)
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			f.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// watchContext interrupt the reads and writes of conn when ctx is done. The
+// returned stop ends the watch, and reports whether conn is still usable.
+func watchContext(ctx context.Context, conn net.Conn) (stop func() bool) {
+	done := make(chan struct{})
+	exited := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+			exited <- false
+		case <-done:
+			exited <- true
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-exited
+	}
+}
+
+// badGateway write 502 to the client. The error is not written because it
+// may contain the address of the backend.
+func badGateway(w http.ResponseWriter) {
+	http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+}
+
+// headerName returns HTTP header name for the uwsgi var.
+func headerName(k string) string {
+	return textproto.CanonicalMIMEHeaderKey(strings.Replace(strings.TrimPrefix(k, "HTTP_"), "_", "-", -1))
+}
+
+// requestVars build uWSGI vars from the request.
+func requestVars(req *http.Request) map[string][]string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	// The port is the default for the scheme without the explicit one.
+	name, port := splitHostPort(host)
+	if port == "" {
+		port = "80"
+		if req.TLS != nil {
+			port = "443"
+		}
+	}
+	remoteAddr, remotePort := splitHostPort(req.RemoteAddr)
+
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+
+	proto := req.Proto
+	if proto == "" || req.ProtoMajor >= 2 {
+		proto = "HTTP/1.1"
 	}
 
 	header := make(map[string][]string)
 	header["REQUEST_METHOD"] = []string{req.Method}
-	header["REQUEST_URI"] = []string{req.RequestURI}
+	header["REQUEST_URI"] = []string{uri}
 	header["CONTENT_LENGTH"] = []string{strconv.Itoa(int(req.ContentLength))}
-	header["SERVER_PROTOCOL"] = []string{req.Proto}
-	header["SERVER_NAME"] = []string{req.Host}
-	header["SERVER_ADDR"] = []string{req.RemoteAddr}
+	header["SERVER_PROTOCOL"] = []string{proto}
+	header["GATEWAY_INTERFACE"] = []string{"CGI/1.1"}
+	header["SERVER_SOFTWARE"] = []string{DefaultServerSoftware}
+	header["HTTP_HOST"] = []string{host}
+	header["SERVER_NAME"] = []string{name}
 	header["SERVER_PORT"] = []string{port}
-	header["REMOTE_HOST"] = []string{req.RemoteAddr}
-	header["REMOTE_ADDR"] = []string{req.RemoteAddr}
-	header["SCRIPT_NAME"] = []string{req.URL.Path}
+	header["REMOTE_HOST"] = []string{remoteAddr}
+	header["REMOTE_ADDR"] = []string{remoteAddr}
+	if remotePort != "" {
+		header["REMOTE_PORT"] = []string{remotePort}
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if serverAddr, _ := splitHostPort(addr.String()); serverAddr != "" {
+			header["SERVER_ADDR"] = []string{serverAddr}
+		}
+	}
+	header["SCRIPT_NAME"] = []string{""}
 	header["PATH_INFO"] = []string{req.URL.Path}
 	header["QUERY_STRING"] = []string{req.URL.RawQuery}
 	if ctype := req.Header.Get("Content-Type"); ctype != "" {
 		header["CONTENT_TYPE"] = []string{ctype}
 	}
+	if req.TLS != nil {
+		header["HTTPS"] = []string{"on"}
+	}
 	for k, v := range req.Header {
 		if _, ok := header[k]; ok == false {
 			k = "HTTP_" + strings.ToUpper(strings.Replace(k, "-", "_", -1))
 			header[k] = v
 		}
 	}
+	return header
+}
 
-	var size uint16
-	for k, v := range header {
-		for _, vv := range v {
-			size += uint16(len(([]byte)(k))) + 2
-			size += uint16(len(([]byte)(vv))) + 2
-		}
+// splitHostPort split the host and the port, which may be missing. The
+// brackets of IPv6 address are removed.
+func splitHostPort(hostport string) (host, port string) {
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		return h, p
 	}
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]"), ""
+}
 
-	hsize := make([]byte, 4)
-	binary.LittleEndian.PutUint16(hsize[1:3], size)
-	conn.Write(hsize)
-
-	for k, v := range header {
-		for _, vv := range v {
-			binary.Write(conn, binary.LittleEndian, uint16(len(([]byte)(k))))
-			conn.Write([]byte(k))
-			binary.Write(conn, binary.LittleEndian, uint16(len(([]byte)(vv))))
-			conn.Write([]byte(vv))
+// forwardedVars append the peer to HTTP_X_FORWARDED_FOR, and use the
+// original client as REMOTE_ADDR if trust is true.
+func forwardedVars(vars map[string][]string, req *http.Request, trust bool) {
+	peer, _ := splitHostPort(req.RemoteAddr)
+	chain := strings.Join(req.Header["X-Forwarded-For"], ", ")
+	if trust && chain != "" {
+		client := strings.TrimSpace(strings.SplitN(chain, ",", 2)[0])
+		if client != "" {
+			vars["REMOTE_ADDR"] = []string{client}
+			vars["REMOTE_HOST"] = []string{client}
 		}
 	}
+	if peer == "" {
+		return
+	}
+	if chain != "" {
+		chain += ", "
+	}
+	vars["HTTP_X_FORWARDED_FOR"] = []string{chain + peer}
+}
 
-	io.Copy(conn, req.Body)
-
-	res, err := http.ReadResponse(bufio.NewReader(conn), req)
-	if err != nil {
-		panic(err.Error())
+// mountVars split the path into SCRIPT_NAME and PATH_INFO at the mount
+// point, on the boundary of the segments.
+func mountVars(vars map[string][]string, scriptName, path string) {
+	scriptName = strings.TrimSuffix(scriptName, "/")
+	if scriptName == "" || !strings.HasPrefix(path, scriptName) {
+		return
 	}
-	for k, v := range res.Header {
-		w.Header().Del(k)
-		for _, vv := range v {
-			w.Header().Add(k, vv)
-		}
+	rest := path[len(scriptName):]
+	if rest != "" && rest[0] != '/' {
+		return
 	}
-	io.Copy(w, res.Body)
+	vars["SCRIPT_NAME"] = []string{scriptName}
+	vars["PATH_INFO"] = []string{rest}
 }
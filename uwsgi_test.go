@@ -2,12 +2,26 @@ package uwsgi
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -29,9 +43,12 @@ func TestBasic(t *testing.T) {
 	}
 	addr, _ := l.Addr().(*net.TCPAddr)
 
+	var mu sync.Mutex
 	var lastReq *http.Request
 	reqNum := 0
 	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
 		reqNum++
 
 		v := fmt.Sprintf("bar%d", reqNum)
@@ -42,7 +59,7 @@ func TestBasic(t *testing.T) {
 	})
 
 	server := &http.Server{Handler: handler}
-	go server.Serve(&Listener{l})
+	go server.Serve(&Listener{Listener: l})
 
 	m := map[string]string{
 		"HOST":              "localhost",
@@ -72,7 +89,10 @@ func TestBasic(t *testing.T) {
 		fmt.Fprintf(fd, "foo=bar%d", n)
 		time.Sleep(1e9)
 
-		res, _ := http.ReadResponse(bufio.NewReader(fd), lastReq)
+		mu.Lock()
+		req := lastReq
+		mu.Unlock()
+		res, _ := http.ReadResponse(bufio.NewReader(fd), req)
 		got := res.Request.Method
 		expected := "POST"
 		if string(got) != expected {
@@ -100,3 +120,2495 @@ func TestBasic(t *testing.T) {
 
 	l.Close()
 }
+
+func TestAllowedModifiers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+
+	called := false
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		called = true
+	})
+	server := &http.Server{Handler: handler}
+	go server.Serve(&Listener{Listener: l, AllowedModifiers: []uint8{0}})
+
+	fd, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+
+	// modifier1=5 with the maximum datasize, and no vars follow.
+	fd.Write([]byte{5, 0xff, 0xff, 0})
+	fd.SetReadDeadline(time.Now().Add(time.Second))
+	var b [1]byte
+	if _, err := fd.Read(b[:]); err != io.EOF {
+		t.Fatalf("Unexpected read error; got %v; expected %v", err, io.EOF)
+	}
+	if called {
+		t.Fatal("Handler should not be called")
+	}
+}
+
+func TestDefaultModifier(t *testing.T) {
+	called := false
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+
+	// The spooler packet, modifier1=17, whose vars look like a request.
+	var buf bytes.Buffer
+	writePacket(&buf, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	})
+	b := buf.Bytes()
+	b[0] = 17
+	fd.Write(b)
+	fd.SetReadDeadline(time.Now().Add(time.Second))
+	// The connection is closed, possibly with RST as the vars are unread.
+	_, err = fd.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Fatalf("Expected the connection to be closed; got %v", err)
+	}
+	if called {
+		t.Fatal("Handler should not be called")
+	}
+}
+
+func TestUnsupportedModifierAction(t *testing.T) {
+	for _, action := range []ModifierAction{ModifierClose, ModifierLog, ModifierRespond} {
+		var logs syncBuffer
+		ul := &Listener{UnsupportedModifierAction: action, ErrorLog: log.New(&logs, "", 0)}
+		addr := startListener(t, ul, http.NotFoundHandler())
+
+		fd, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		fd.Write([]byte{200, 0, 0, 0})
+		fd.SetReadDeadline(time.Now().Add(time.Second))
+		got, err := ioutil.ReadAll(fd)
+		fd.Close()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("Connection is not closed for action %d", action)
+		}
+
+		if action == ModifierRespond {
+			res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(got)), nil)
+			if err != nil {
+				t.Fatalf("read response error: %v", err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			if res.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "modifier1 200") {
+				t.Errorf("Unexpected response; got %d %q", res.StatusCode, string(body))
+			}
+		} else if len(got) != 0 {
+			t.Errorf("Unexpected response for action %d; got %q", action, got)
+		}
+
+		// The error is reported after the connection is closed.
+		deadline := time.Now().Add(time.Second)
+		for !strings.Contains(logs.String(), "modifier1 200") && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !strings.Contains(logs.String(), "modifier1 200") {
+			t.Errorf("The modifier is not logged for action %d; got %q", action, logs.String())
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		called := false
+		addr := startListener(t, &Listener{DisablePing: disable}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+
+		fd, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		fd.Write([]byte{ModifierPing, 0, 0, 0})
+		fd.SetReadDeadline(time.Now().Add(time.Second))
+		got, err := ioutil.ReadAll(fd)
+		fd.Close()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("Connection is not closed with DisablePing=%v", disable)
+		}
+		expected := []byte{ModifierPing, 0, 0, 0}
+		if disable {
+			expected = []byte{}
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("Unexpected ping response with DisablePing=%v; got %v; expected %v", disable, got, expected)
+		}
+		if called {
+			t.Errorf("Handler should not be called with DisablePing=%v", disable)
+		}
+	}
+}
+
+func TestFragmentedHeader(t *testing.T) {
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	fd.(*net.TCPConn).SetNoDelay(true)
+
+	var buf bytes.Buffer
+	writePacket(&buf, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/fragmented",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	})
+	b := buf.Bytes()
+	// The 4-byte header arrives in two segments.
+	fd.Write(b[:2])
+	time.Sleep(50 * time.Millisecond)
+	fd.Write(b[2:])
+
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "/fragmented" {
+		t.Errorf("Unexpected body; got %q; expected %q", string(body), "/fragmented")
+	}
+}
+
+// startListener serve handler on the uWSGI listener and returns its address.
+func startListener(t *testing.T, ul *Listener, handler http.Handler) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ul.Listener = l
+
+	server := &http.Server{Handler: handler, ConnContext: ul.ConnContext}
+	go server.Serve(ul)
+	return l.Addr().String()
+}
+
+func TestPassengerGzipPassthrough(t *testing.T) {
+	const content = "hello gzip world"
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte(content))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(content))
+		gz.Close()
+	}))
+
+	front := httptest.NewServer(Passenger{Net: "tcp", Addr: addr})
+	defer front.Close()
+
+	req, _ := http.NewRequest("GET", front.URL+"/", nil)
+	// Set explicitly so that the client does not decompress transparently.
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer res.Body.Close()
+
+	if got := res.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Unexpected Content-Encoding; got %q; expected %q", got, "gzip")
+	}
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatalf("gzip error: %v", err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("gzip error: %v", err)
+	}
+	if string(body) != content {
+		t.Errorf("Unexpected body; got %q; expected %q", string(body), content)
+	}
+}
+
+// writePacket write uWSGI packet which has the vars.
+func writePacket(fd io.Writer, m map[string]string) {
+	vars := make(map[string][]string, len(m))
+	for k, v := range m {
+		vars[k] = []string{v}
+	}
+	WritePacket(fd, 0, 0, vars)
+}
+
+func TestConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	ul := &Listener{Listener: l}
+	defer ul.Close()
+
+	fd, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, map[string]string{
+		"REQUEST_METHOD":  "POST",
+		"REQUEST_URI":     "/foo",
+		"CONTENT_LENGTH":  "7",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	})
+	fd.Write([]byte("foo=bar"))
+
+	var c net.Conn
+	c, err = ul.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	if c.RemoteAddr().String() != fd.LocalAddr().String() {
+		t.Errorf("Unexpected remote address; got %v; expected %v", c.RemoteAddr(), fd.LocalAddr())
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		t.Fatalf("read request error: %v", err)
+	}
+	if req.Method != "POST" || req.URL.Path != "/foo" || req.Host != "localhost" {
+		t.Errorf("Unexpected request; got %s %s (host %s)", req.Method, req.URL.Path, req.Host)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if string(body) != "foo=bar" {
+		t.Errorf("Unexpected body; got %q; expected %q", string(body), "foo=bar")
+	}
+
+	c.Write([]byte("pong"))
+	c.Close()
+	got, _ := ioutil.ReadAll(fd)
+	if string(got) != "pong" {
+		t.Errorf("Unexpected response; got %q; expected %q", string(got), "pong")
+	}
+}
+
+func TestConnParseError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	ul := &Listener{Listener: l}
+	defer ul.Close()
+
+	fd, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+
+	c, err := ul.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer c.Close()
+
+	// Read is waiting before the malformed vars arrive.
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	fd.Write([]byte{0, 4, 0, 0, 100, 0, 0, 0})
+
+	select {
+	case err := <-done:
+		if _, ok := err.(*ParseError); !ok {
+			t.Errorf("Unexpected error; got %v; expected ParseError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read hung after the parse error")
+	}
+}
+
+// TestConnRace hammers a connection from both sides while its vars are
+// parsed; run with -race.
+func TestConnRace(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	ul := &Listener{Listener: l}
+	defer ul.Close()
+
+	for _, bad := range []bool{false, true} {
+		fd, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		c, err := ul.Accept()
+		if err != nil {
+			t.Fatalf("accept error: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b := make([]byte, 16)
+				for j := 0; j < 100; j++ {
+					c.SetDeadline(time.Now().Add(time.Second))
+					c.SetReadDeadline(time.Now().Add(time.Second))
+					c.SetWriteDeadline(time.Now().Add(time.Second))
+					if _, err := c.Read(b); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		if bad {
+			fd.Write([]byte{0, 4, 0, 0, 100, 0, 0, 0})
+		} else {
+			writePacket(fd, map[string]string{
+				"REQUEST_METHOD":  "POST",
+				"REQUEST_URI":     "/",
+				"CONTENT_LENGTH":  "5",
+				"SERVER_PROTOCOL": "HTTP/1.1",
+				"HTTP_HOST":       "localhost",
+			})
+			fd.Write([]byte("hello"))
+			fd.Close()
+		}
+		wg.Wait()
+
+		// The error is kept for the later operations.
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Errorf("Expected read error (bad=%v)", bad)
+		}
+		if bad {
+			if _, err := c.Write([]byte("x")); err == nil {
+				t.Error("Expected write error")
+			}
+		}
+		c.Close()
+		fd.Close()
+	}
+}
+
+func TestPassengerExpectContinue(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		fd, err := l.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer fd.Close()
+
+		var head [4]byte
+		io.ReadFull(fd, head[:])
+		vars := make([]byte, binary.LittleEndian.Uint16(head[1:3]))
+		io.ReadFull(fd, vars)
+		if !bytes.Contains(vars, []byte("HTTP_EXPECT")) {
+			errc <- fmt.Errorf("HTTP_EXPECT is not forwarded")
+			return
+		}
+
+		// The body must not arrive before the interim response.
+		var b [5]byte
+		fd.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, _ := fd.Read(b[:]); n != 0 {
+			errc <- fmt.Errorf("body is sent before 100 Continue")
+			return
+		}
+		fd.SetReadDeadline(time.Time{})
+
+		fd.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+		if _, err := io.ReadFull(fd, b[:]); err != nil {
+			errc <- err
+			return
+		}
+		fmt.Fprintf(fd, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(b), b[:])
+		errc <- nil
+	}()
+
+	front := httptest.NewServer(Passenger{Net: "tcp", Addr: l.Addr().String(), ExpectContinueTimeout: 5 * time.Second})
+	defer front.Close()
+
+	got100 := false
+	trace := &httptrace.ClientTrace{Got100Continue: func() { got100 = true }}
+	req, _ := http.NewRequest("PUT", front.URL+"/", strings.NewReader("hello"))
+	req.Header.Set("Expect", "100-continue")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err := <-errc; err != nil {
+		t.Fatalf("backend error: %v", err)
+	}
+
+	if !got100 {
+		t.Error("100 Continue is not relayed to the client")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Body is held too long; took %v", d)
+	}
+	if string(body) != "hello" {
+		t.Errorf("Unexpected body; got %q; expected %q", string(body), "hello")
+	}
+}
+
+func TestMaxHeaders(t *testing.T) {
+	called := false
+	addr := startListener(t, &Listener{MaxHeaders: 5}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"HTTP_X_A":        "a",
+		"HTTP_X_B":        "b",
+		"HTTP_X_C":        "c",
+	})
+
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	if res.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Unexpected status; got %d; expected %d", res.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	}
+	if called {
+		t.Error("Handler should not be called")
+	}
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestMaxHeadersMergedCookies(t *testing.T) {
+	var cookies int
+	addr := startListener(t, &Listener{MaxHeaders: 6}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = len(r.Cookies())
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	// Host, the three vars of the request line, Cookie and Connection.
+	WritePacket(fd, ModifierHTTP, 0, map[string][]string{
+		"REQUEST_METHOD":  {"GET"},
+		"REQUEST_URI":     {"/"},
+		"SERVER_PROTOCOL": {"HTTP/1.1"},
+		"HTTP_HOST":       {"localhost"},
+		"HTTP_COOKIE":     {"a=1", "b=2", "c=3", "d=4", "e=5"},
+	})
+
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || cookies != 5 {
+		t.Errorf("Unexpected response; got %d with %d cookies; expected %d with %d", res.StatusCode, cookies, http.StatusOK, 5)
+	}
+}
+
+func TestDebugWriter(t *testing.T) {
+	var debug syncBuffer
+	addr := startListener(t, &Listener{DebugWriter: &debug}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, map[string]string{
+		"REQUEST_METHOD":  "POST",
+		"REQUEST_URI":     "/foo",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"CONTENT_LENGTH":  "6",
+		"HTTP_HOST":       "localhost",
+		"HTTP_USER_AGENT": "go",
+	})
+	fd.Write([]byte("secret"))
+
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	res.Body.Close()
+
+	got := debug.String()
+	for _, expected := range []string{"POST /foo HTTP/1.0\r\n", "User-Agent: go\r\n", "Host: localhost\r\n", "HTTP_USER_AGENT"} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("Debug output does not contain %q; got %q", expected, got)
+		}
+	}
+	if strings.Contains(got, "secret") {
+		t.Errorf("Debug output should not contain the body; got %q", got)
+	}
+}
+
+func TestConnectionHeader(t *testing.T) {
+	for _, keepAlive := range []bool{false, true} {
+		var got string
+		var gotClose bool
+		addr := startListener(t, &Listener{KeepAlive: keepAlive}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header.Get("Connection")
+			gotClose = r.Close
+		}))
+
+		fd, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		writePacket(fd, map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"REQUEST_URI":     "/",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+			"HTTP_CONNECTION": "keep-alive",
+		})
+		res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+		if err != nil {
+			t.Fatalf("read response error: %v", err)
+		}
+		res.Body.Close()
+		fd.Close()
+
+		expected := "close"
+		if keepAlive {
+			expected = "keep-alive"
+		}
+		if got != expected {
+			t.Errorf("Unexpected Connection with KeepAlive=%v; got %q; expected %q", keepAlive, got, expected)
+		}
+		if gotClose == keepAlive {
+			t.Errorf("Unexpected Request.Close with KeepAlive=%v; got %v", keepAlive, gotClose)
+		}
+	}
+}
+
+func BenchmarkLargeBody(b *testing.B) {
+	const size = 1 << 30
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	})}
+	go server.Serve(&Listener{Listener: l})
+
+	m := map[string]string{
+		"REQUEST_METHOD":  "PUT",
+		"REQUEST_URI":     "/upload",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"CONTENT_LENGTH":  strconv.Itoa(size),
+	}
+	chunk := make([]byte, 64*1024)
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		fd, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			b.Fatalf("dial error: %v", err)
+		}
+		writePacket(fd, m)
+		for sent := 0; sent < size; sent += len(chunk) {
+			if _, err := fd.Write(chunk); err != nil {
+				b.Fatalf("write error: %v", err)
+			}
+		}
+		res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+		if err != nil {
+			b.Fatalf("read response error: %v", err)
+		}
+		res.Body.Close()
+		fd.Close()
+	}
+}
+
+func TestContentTypeVars(t *testing.T) {
+	for _, vars := range []map[string]string{
+		{"CONTENT_TYPE": "application/x-www-form-urlencoded"},
+		{"HTTP_CONTENT_TYPE": "application/x-www-form-urlencoded"},
+		{"CONTENT_TYPE": "application/x-www-form-urlencoded", "HTTP_CONTENT_TYPE": "text/plain"},
+		{"CONTENT_TYPE": "", "HTTP_CONTENT_TYPE": "application/x-www-form-urlencoded"},
+	} {
+		var ctype []string
+		var foo string
+		addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctype = r.Header["Content-Type"]
+			foo = r.PostFormValue("foo")
+		}))
+
+		m := map[string]string{
+			"REQUEST_METHOD":  "POST",
+			"REQUEST_URI":     "/",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+			"CONTENT_LENGTH":  "7",
+		}
+		for k, v := range vars {
+			m[k] = v
+		}
+		res := doRequest(t, addr, m, "foo=bar")
+		res.Body.Close()
+
+		if len(ctype) != 1 || ctype[0] != "application/x-www-form-urlencoded" {
+			t.Errorf("Unexpected Content-Type for %v; got %q", vars, ctype)
+		}
+		if foo != "bar" {
+			t.Errorf("Unexpected form value for %v; got %q; expected %q", vars, foo, "bar")
+		}
+	}
+}
+
+func TestEmptyContentType(t *testing.T) {
+	var ctype []string
+	var ok bool
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctype, ok = r.Header["Content-Type"]
+	}))
+
+	// nginx sends the empty CONTENT_TYPE for the requests without body.
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"CONTENT_TYPE":    "",
+		"CONTENT_LENGTH":  "",
+	}, "")
+	res.Body.Close()
+	if ok {
+		t.Errorf("Unexpected Content-Type for the empty CONTENT_TYPE; got %q", ctype)
+	}
+}
+
+func TestPassengerResponse(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError} {
+		addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Multi", "a")
+			w.Header().Add("X-Multi", "b")
+			w.Header().Set("Content-Type", "text/x-test")
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "status=%d", status)
+		}))
+		front := httptest.NewServer(Passenger{Net: "tcp", Addr: addr})
+
+		res, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		front.Close()
+
+		if res.StatusCode != status {
+			t.Errorf("Unexpected status; got %d; expected %d", res.StatusCode, status)
+		}
+		if got := res.Header["X-Multi"]; len(got) != 2 || got[0] != "a" || got[1] != "b" {
+			t.Errorf("Unexpected X-Multi for %d; got %q", status, got)
+		}
+		if got := res.Header.Get("Content-Type"); got != "text/x-test" {
+			t.Errorf("Unexpected Content-Type for %d; got %q", status, got)
+		}
+		if expected := fmt.Sprintf("status=%d", status); string(body) != expected {
+			t.Errorf("Unexpected body; got %q; expected %q", string(body), expected)
+		}
+	}
+}
+
+func TestPassengerStatusWithoutBody(t *testing.T) {
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	front := httptest.NewServer(Passenger{Net: "tcp", Addr: addr})
+	defer front.Close()
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for path, status := range map[string]int{"/redirect": http.StatusFound, "/empty": http.StatusNoContent} {
+		res, err := client.Get(front.URL + path)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("Unexpected status for %s; got %d; expected %d", path, res.StatusCode, status)
+		}
+		if path == "/redirect" && res.Header.Get("Location") != "/elsewhere" {
+			t.Errorf("Unexpected Location; got %q; expected %q", res.Header.Get("Location"), "/elsewhere")
+		}
+	}
+}
+
+func TestPassengerStreaming(t *testing.T) {
+	next := make(chan bool)
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-next
+		fmt.Fprint(w, "data: second\n\n")
+	}))
+	front := httptest.NewServer(Passenger{Net: "tcp", Addr: addr})
+	defer front.Close()
+
+	// The headers and the first event arrive while the backend is still
+	// writing; the timeout fails the test instead of hanging.
+	defer close(next)
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get(front.URL + "/events")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer res.Body.Close()
+
+	got := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(res.Body).ReadString('\n')
+		got <- line
+	}()
+	select {
+	case line := <-got:
+		if line != "data: first\n" {
+			t.Errorf("Unexpected event; got %q; expected %q", line, "data: first\n")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The first event is not streamed")
+	}
+}
+
+func TestAbsoluteRequestURI(t *testing.T) {
+	var got *http.Request
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "http://example.com:8080/a/b?x=1",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "other",
+	}, "")
+	res.Body.Close()
+
+	if got.Host != "example.com:8080" {
+		t.Errorf("Unexpected host; got %q; expected %q", got.Host, "example.com:8080")
+	}
+	if got.URL.Host != "" || got.URL.Path != "/a/b" || got.URL.RawQuery != "x=1" {
+		t.Errorf("Unexpected URL; got %v", got.URL)
+	}
+	if got.RequestURI != "/a/b?x=1" {
+		t.Errorf("Unexpected request URI; got %q; expected %q", got.RequestURI, "/a/b?x=1")
+	}
+}
+
+// benchmarkEnv returns typical uwsgi vars with n headers.
+func benchmarkEnv(n int) map[string][]string {
+	env := map[string][]string{
+		"REQUEST_METHOD":  {"GET"},
+		"REQUEST_URI":     {"/index.html?foo=bar"},
+		"SERVER_PROTOCOL": {"HTTP/1.0"},
+		"HTTP_HOST":       {"localhost"},
+	}
+	for i := len(env); i < n; i++ {
+		env[fmt.Sprintf("HTTP_X_HEADER_%d", i)] = []string{"some value of the header"}
+	}
+	return env
+}
+
+func BenchmarkBuildRequest(b *testing.B) {
+	l := &Listener{}
+	env := benchmarkEnv(40)
+	size := 0
+	for k, v := range env {
+		size += len(k) + len(v[0]) + 4
+	}
+
+	buf := make([]byte, 0, size+64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, _, err := l.buildRequest(buf, env); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHeaderOrder(t *testing.T) {
+	l := &Listener{}
+	env := map[string][]string{
+		"REQUEST_METHOD":  {"GET"},
+		"REQUEST_URI":     {"/"},
+		"SERVER_PROTOCOL": {"HTTP/1.1"},
+		"HTTP_HOST":       {"localhost"},
+		"HTTP_X_B":        {"b"},
+		"HTTP_ACCEPT":     {"*/*"},
+		"HTTP_X_A":        {"a1", "a2"},
+		"CONTENT_TYPE":    {"text/plain"},
+		"CONTENT_LENGTH":  {"0"},
+	}
+	expected := "GET / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\nContent-Type: text/plain\r\n" +
+		"Accept: */*\r\nX-A: a1\r\nX-A: a2\r\nX-B: b\r\n" +
+		"REQUEST_METHOD: GET\r\nREQUEST_URI: /\r\nSERVER_PROTOCOL: HTTP/1.1\r\nConnection: close\r\n\r\n"
+	for i := 0; i < 20; i++ {
+		hdr, _, err := l.buildRequest(nil, env)
+		if err != nil {
+			t.Fatalf("buildRequest error: %v", err)
+		}
+		if string(hdr) != expected {
+			t.Fatalf("Unexpected header block; got %q; expected %q", hdr, expected)
+		}
+	}
+}
+
+func TestInvalidRequestURI(t *testing.T) {
+	called := false
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	for _, uri := range []string{"/foo bar", "/foo\nbar", "/foo#bar", "/foo%zz", "/foo%2"} {
+		res := doRequest(t, addr, map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"REQUEST_URI":     uri,
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+		}, "")
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Unexpected status for %q; got %d; expected %d", uri, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+	if called {
+		t.Error("Handler should not be called")
+	}
+}
+
+func BenchmarkBuildRequestBrowser(b *testing.B) {
+	l := &Listener{}
+	env := map[string][]string{
+		"REQUEST_METHOD":                 {"GET"},
+		"REQUEST_URI":                    {"/index.html?foo=bar"},
+		"SERVER_PROTOCOL":                {"HTTP/1.0"},
+		"HTTP_HOST":                      {"www.example.com"},
+		"HTTP_USER_AGENT":                {"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"},
+		"HTTP_ACCEPT":                    {"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+		"HTTP_ACCEPT_LANGUAGE":           {"en-US,en;q=0.5"},
+		"HTTP_ACCEPT_ENCODING":           {"gzip, deflate, br"},
+		"HTTP_REFERER":                   {"https://www.example.com/"},
+		"HTTP_COOKIE":                    {"session=0123456789abcdef; theme=dark"},
+		"HTTP_UPGRADE_INSECURE_REQUESTS": {"1"},
+		"HTTP_SEC_FETCH_DEST":            {"document"},
+		"HTTP_SEC_FETCH_MODE":            {"navigate"},
+		"HTTP_SEC_FETCH_SITE":            {"same-origin"},
+		"HTTP_SEC_FETCH_USER":            {"?1"},
+		"HTTP_IF_MODIFIED_SINCE":         {"Mon, 01 Jan 2024 00:00:00 GMT"},
+		"HTTP_IF_NONE_MATCH":             {`"abcdef"`},
+		"HTTP_CACHE_CONTROL":             {"max-age=0"},
+	}
+	size := 0
+	for k, v := range env {
+		size += len(k) + len(v[0]) + 4
+	}
+
+	buf := make([]byte, 0, size+64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, _, err := l.buildRequest(buf, env); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAppendHeaderName(t *testing.T) {
+	tests := map[string]string{
+		"USER_AGENT":       "User-Agent",
+		"X_FORWARDED_FOR":  "X-Forwarded-For",
+		"dnt":              "Dnt",
+		"X__A":             "X--A",
+		"X_REQUESTED_WITH": "X-Requested-With",
+	}
+	for name, expected := range tests {
+		if got := string(appendHeaderName(nil, name)); got != expected {
+			t.Errorf("Unexpected header name for %q; got %q; expected %q", name, got, expected)
+		}
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	// Passenger maps Foo-Bar to HTTP_FOO_BAR, and Listener maps it back.
+	var header http.Header
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	front := httptest.NewServer(Passenger{Net: "tcp", Addr: addr})
+	defer front.Close()
+
+	req, _ := http.NewRequest("GET", front.URL+"/", nil)
+	req.Header.Set("Foo-Bar", "baz")
+	req.Header.Set("X-Custom-Header-Name", "qux")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	res.Body.Close()
+
+	for k, v := range map[string]string{"Foo-Bar": "baz", "X-Custom-Header-Name": "qux"} {
+		if got := header.Get(k); got != v {
+			t.Errorf("Unexpected %s; got %q; expected %q", k, got, v)
+		}
+	}
+	for k := range header {
+		if strings.HasPrefix(k, "Http_") || strings.HasPrefix(k, "HTTP_") {
+			t.Errorf("Unexpected header %q", k)
+		}
+	}
+}
+
+func TestXRequestedWith(t *testing.T) {
+	var header http.Header
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":        "GET",
+		"REQUEST_URI":           "/",
+		"SERVER_PROTOCOL":       "HTTP/1.1",
+		"HTTP_HOST":             "localhost",
+		"HTTP_X_REQUESTED_WITH": "XMLHttpRequest",
+	}, "")
+	res.Body.Close()
+	if got := header.Get("X-Requested-With"); got != "XMLHttpRequest" {
+		t.Errorf("Unexpected X-Requested-With; got %q; expected %q", got, "XMLHttpRequest")
+	}
+	if got, ok := header["Requested-With"]; ok {
+		t.Errorf("Unexpected Requested-With; got %q", got)
+	}
+}
+
+// readVars read uWSGI packet and returns the vars.
+func readVars(r io.Reader) (map[string]string, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.LittleEndian.Uint16(head[1:3]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for len(buf) >= 4 {
+		kl := int(binary.LittleEndian.Uint16(buf))
+		k := string(buf[2 : 2+kl])
+		buf = buf[2+kl:]
+		vl := int(binary.LittleEndian.Uint16(buf))
+		m[k] = string(buf[2 : 2+vl])
+		buf = buf[2+vl:]
+	}
+	return m, nil
+}
+
+// startVarsBackend serve uwsgi requests with empty response, and sends the
+// vars of each request to the channel.
+func startVarsBackend(t *testing.T) (string, chan map[string]string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	ch := make(chan map[string]string, 10)
+	go func() {
+		for {
+			fd, err := l.Accept()
+			if err != nil {
+				return
+			}
+			m, err := readVars(fd)
+			if err == nil {
+				ch <- m
+				fd.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+			}
+			fd.Close()
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+// slowBody is the request body which is read slowly. after is set if it is
+// read after returned is set.
+type slowBody struct {
+	n        int
+	returned int32
+	after    int32
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if b.n == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&b.returned) != 0 {
+		atomic.StoreInt32(&b.after, 1)
+	}
+	b.n--
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestPassengerBodyAfterReturn(t *testing.T) {
+	addr, ch := startVarsBackend(t)
+	for _, pool := range []int{0, 1} {
+		body := &slowBody{n: 10}
+		req := httptest.NewRequest("POST", "/", body)
+		req.ContentLength = int64(body.n)
+		Passenger{Net: "tcp", Addr: addr, MaxIdleConns: pool}.ServeHTTP(httptest.NewRecorder(), req)
+		atomic.StoreInt32(&body.returned, 1)
+		<-ch
+
+		time.Sleep(100 * time.Millisecond)
+		if atomic.LoadInt32(&body.after) != 0 {
+			t.Errorf("The body is read after ServeHTTP returned (MaxIdleConns %d)", pool)
+		}
+	}
+}
+
+func TestPassengerServerSoftware(t *testing.T) {
+	addr, ch := startVarsBackend(t)
+	for _, test := range []struct {
+		passenger Passenger
+		expected  string
+	}{
+		{Passenger{Net: "tcp", Addr: addr}, DefaultServerSoftware},
+		{Passenger{Net: "tcp", Addr: addr, ServerSoftware: "myproxy/1.0"}, "myproxy/1.0"},
+	} {
+		test.passenger.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+		m := <-ch
+		if got := m["SERVER_SOFTWARE"]; got != test.expected {
+			t.Errorf("Unexpected SERVER_SOFTWARE; got %q; expected %q", got, test.expected)
+		}
+		if got := m["GATEWAY_INTERFACE"]; got != "CGI/1.1" {
+			t.Errorf("Unexpected GATEWAY_INTERFACE; got %q; expected %q", got, "CGI/1.1")
+		}
+	}
+}
+
+func TestPassengerServerProtocol(t *testing.T) {
+	addr, ch := startVarsBackend(t)
+	tests := []struct {
+		passenger Passenger
+		proto     string
+		major     int
+		expected  string
+	}{
+		{Passenger{Net: "tcp", Addr: addr}, "HTTP/2.0", 2, "HTTP/1.1"},
+		{Passenger{Net: "tcp", Addr: addr}, "HTTP/1.0", 1, "HTTP/1.0"},
+		{Passenger{Net: "tcp", Addr: addr, ServerProtocol: "HTTP/1.0"}, "HTTP/2.0", 2, "HTTP/1.0"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Proto, req.ProtoMajor, req.ProtoMinor = test.proto, test.major, 0
+		test.passenger.ServeHTTP(httptest.NewRecorder(), req)
+
+		m := <-ch
+		if got := m["SERVER_PROTOCOL"]; got != test.expected {
+			t.Errorf("Unexpected SERVER_PROTOCOL for %s; got %q; expected %q", test.proto, got, test.expected)
+		}
+	}
+}
+
+func TestContentLengthAndTransferEncoding(t *testing.T) {
+	called := false
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":         "POST",
+		"REQUEST_URI":            "/",
+		"SERVER_PROTOCOL":        "HTTP/1.1",
+		"HTTP_HOST":              "localhost",
+		"CONTENT_LENGTH":         "5",
+		"HTTP_TRANSFER_ENCODING": "chunked",
+	}, "0\r\n\r\n")
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected status; got %d; expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+	if called {
+		t.Error("Handler should not be called")
+	}
+}
+
+func TestHeadRequest(t *testing.T) {
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello world"))
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, map[string]string{
+		"REQUEST_METHOD":  "HEAD",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	})
+
+	fd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	raw, err := ioutil.ReadAll(fd)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	pos := bytes.Index(raw, []byte("\r\n\r\n"))
+	if pos < 0 {
+		t.Fatalf("Unexpected response; got %q", raw)
+	}
+	if body := raw[pos+4:]; len(body) != 0 {
+		t.Errorf("HEAD response should not have body; got %q", body)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), &http.Request{Method: "HEAD"})
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status; got %d; expected %d", res.StatusCode, http.StatusOK)
+	}
+	if got := res.Header.Get("Content-Length"); got != "11" {
+		t.Errorf("Unexpected Content-Length; got %q; expected %q", got, "11")
+	}
+	if got := res.Header.Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Unexpected Content-Type; got %q; expected %q", got, "text/plain")
+	}
+}
+
+func TestTunnelHandler(t *testing.T) {
+	var target string
+	ul := &Listener{TunnelHandler: func(conn net.Conn, env map[string][]string) {
+		defer conn.Close()
+		target = env["REQUEST_URI"][0]
+		var b [4]byte
+		if _, err := io.ReadFull(conn, b[:]); err == nil {
+			conn.Write(b[:])
+		}
+	}}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler should not be called for CONNECT")
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, map[string]string{
+		"REQUEST_METHOD":  "CONNECT",
+		"REQUEST_URI":     "example.com:443",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "example.com:443",
+	})
+	fd.Write([]byte("ping"))
+
+	fd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(fd)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("Unexpected tunneled bytes; got %q; expected %q", string(got), "ping")
+	}
+	if target != "example.com:443" {
+		t.Errorf("Unexpected target; got %q; expected %q", target, "example.com:443")
+	}
+}
+
+func TestDefaultHost(t *testing.T) {
+	var host string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	})
+	m := map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+	}
+
+	res := doRequest(t, startListener(t, &Listener{}, handler), m, "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected status without host; got %d; expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+
+	addr := startListener(t, &Listener{DefaultHost: "default.example"}, handler)
+	res = doRequest(t, addr, m, "")
+	res.Body.Close()
+	if host != "default.example" {
+		t.Errorf("Unexpected host; got %q; expected %q", host, "default.example")
+	}
+
+	m["SERVER_NAME"] = "server.example"
+	m["SERVER_PORT"] = "8080"
+	res = doRequest(t, addr, m, "")
+	res.Body.Close()
+	if host != "server.example:8080" {
+		t.Errorf("Unexpected host; got %q; expected %q", host, "server.example:8080")
+	}
+}
+
+func TestShortBody(t *testing.T) {
+	type mismatch struct{ declared, read int64 }
+	ch := make(chan mismatch, 1)
+	ul := &Listener{OnShortBody: func(c *Conn, declared, read int64) {
+		ch <- mismatch{declared, read}
+	}}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, map[string]string{
+		"REQUEST_METHOD":  "POST",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"CONTENT_LENGTH":  "10",
+	})
+	fd.Write([]byte("1234"))
+	fd.(*net.TCPConn).CloseWrite()
+
+	select {
+	case m := <-ch:
+		if m.declared != 10 || m.read != 4 {
+			t.Errorf("Unexpected mismatch; got %+v; expected {declared:10 read:4}", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnShortBody is not called")
+	}
+}
+
+func TestScriptNamePathInfo(t *testing.T) {
+	var uri string
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri = r.URL.RequestURI()
+	}))
+
+	tests := []struct {
+		script, path, query string
+		expected            string
+	}{
+		{"", "/a/b", "", "/a/b"},
+		{"/app", "/a/b", "", "/app/a/b"},
+		{"/app", "", "x=1", "/app?x=1"},
+		{"", "/a b", "", "/a%20b"},
+	}
+	for _, test := range tests {
+		m := map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+			"SCRIPT_NAME":     test.script,
+			"PATH_INFO":       test.path,
+			"QUERY_STRING":    test.query,
+		}
+		uri = ""
+		res := doRequest(t, addr, m, "")
+		res.Body.Close()
+		if uri != test.expected {
+			t.Errorf("Unexpected URI for SCRIPT_NAME=%q PATH_INFO=%q; got %q; expected %q", test.script, test.path, uri, test.expected)
+		}
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	m := map[string]string{
+		"REQUEST_METHOD":  "POST",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"CONTENT_LENGTH":  "100",
+	}
+	packet := 4
+	for k, v := range m {
+		packet += len(k) + len(v) + 4
+	}
+
+	ch := make(chan error, 1)
+	ul := &Listener{MaxRequestBytes: int64(packet + 150)}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		ch <- err
+	}))
+
+	res := doRequest(t, addr, m, strings.Repeat("x", 100))
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status under the limit; got %d; expected %d", res.StatusCode, http.StatusOK)
+	}
+	if err := <-ch; err != nil {
+		t.Errorf("Unexpected body error under the limit: %v", err)
+	}
+
+	m["CONTENT_LENGTH"] = "200"
+	res = doRequest(t, addr, m, "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Unexpected status for declared body; got %d; expected %d", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+
+	// HTTP_CONTENT_LENGTH isn't checked up front, so the body is cut while
+	// reading.
+	delete(m, "CONTENT_LENGTH")
+	m["HTTP_CONTENT_LENGTH"] = "200"
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, m)
+	fd.Write([]byte(strings.Repeat("x", 200)))
+	select {
+	case err := <-ch:
+		if err == nil {
+			t.Error("Expected body error over the limit")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler is not called")
+	}
+}
+
+func TestInlineParse(t *testing.T) {
+	var body string
+	addr := startListener(t, &Listener{InlineParse: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+
+	m := map[string]string{
+		"REQUEST_METHOD":  "POST",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"CONTENT_LENGTH":  "5",
+	}
+	res := doRequest(t, addr, m, "hello")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || body != "hello" {
+		t.Errorf("Unexpected response; got %d %q; expected %d %q", res.StatusCode, body, http.StatusOK, "hello")
+	}
+
+	m["REQUEST_URI"] = "/a b"
+	res = doRequest(t, addr, m, "hello")
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected status; got %d; expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// BenchmarkGoroutines reports the goroutines per idle connection, which has
+// not sent the uwsgi packet yet.
+func BenchmarkGoroutines(b *testing.B) {
+	for _, inline := range []bool{false, true} {
+		b.Run(fmt.Sprintf("inline=%v", inline), func(b *testing.B) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatalf("listen error: %v", err)
+			}
+			defer l.Close()
+			server := &http.Server{Handler: http.NotFoundHandler()}
+			go server.Serve(&Listener{Listener: l, InlineParse: inline})
+			defer server.Close()
+
+			before := runtime.NumGoroutine()
+			conns := make([]net.Conn, 0, b.N)
+			for n := 0; n < b.N; n++ {
+				fd, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					b.Fatalf("dial error: %v", err)
+				}
+				conns = append(conns, fd)
+			}
+			// Wait for the server to pick up the connections.
+			for i := 0; i < 100 && runtime.NumGoroutine()-before < b.N; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(10 * time.Millisecond)
+			b.ReportMetric(float64(runtime.NumGoroutine()-before)/float64(b.N), "goroutines/conn")
+			for _, fd := range conns {
+				fd.Close()
+			}
+		})
+	}
+}
+
+func TestEmptyRequestURI(t *testing.T) {
+	var path, query string
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, query = r.URL.Path, r.URL.RawQuery
+	}))
+
+	tests := []struct {
+		uri         string
+		path, query string
+	}{
+		{"/", "/", ""},
+		{"", "/", ""},
+		{"?foo=bar", "/", "foo=bar"},
+		{"/?foo=bar", "/", "foo=bar"},
+	}
+	for _, test := range tests {
+		m := map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"REQUEST_URI":     test.uri,
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+		}
+		path, query = "", ""
+		res := doRequest(t, addr, m, "")
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected status for REQUEST_URI=%q; got %d", test.uri, res.StatusCode)
+		}
+		if path != test.path || query != test.query {
+			t.Errorf("Unexpected URL for REQUEST_URI=%q; got %q %q; expected %q %q", test.uri, path, query, test.path, test.query)
+		}
+	}
+}
+
+func TestPassengerBadGateway(t *testing.T) {
+	// A backend which answers garbage.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			fd, err := l.Accept()
+			if err != nil {
+				return
+			}
+			readVars(fd)
+			fd.Write([]byte("garbage\r\n\r\n"))
+			fd.Close()
+		}
+	}()
+
+	// A backend which is not listening.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	closed.Close()
+
+	for _, addr := range []string{l.Addr().String(), closed.Addr().String()} {
+		front := httptest.NewServer(Passenger{Net: "tcp", Addr: addr})
+		res, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		front.Close()
+
+		if res.StatusCode != http.StatusBadGateway {
+			t.Errorf("Unexpected status for %s; got %d; expected %d", addr, res.StatusCode, http.StatusBadGateway)
+		}
+		if strings.Contains(string(body), addr) {
+			t.Errorf("Body leaks the backend address; got %q", string(body))
+		}
+	}
+}
+
+func TestPassengerCancel(t *testing.T) {
+	// A backend which never answers.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			fd, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer fd.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		Passenger{Net: "tcp", Addr: l.Addr().String()}.ServeHTTP(w, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeHTTP is not aborted by the canceled request")
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Unexpected status; got %d; expected %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestDispatchBeforeBody(t *testing.T) {
+	started := make(chan bool, 1)
+	body := make(chan string, 1)
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		b, _ := ioutil.ReadAll(r.Body)
+		body <- string(b)
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, map[string]string{
+		"REQUEST_METHOD":  "POST",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"CONTENT_LENGTH":  "5",
+	})
+
+	// The handler must run before any byte of the body is sent.
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler is not dispatched before the body")
+	}
+	fd.Write([]byte("hello"))
+	select {
+	case got := <-body:
+		if got != "hello" {
+			t.Errorf("Unexpected body; got %q; expected %q", got, "hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Body is not read")
+	}
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	ul := &Listener{Listener: l, HeaderTimeout: 100 * time.Millisecond, InlineParse: true}
+	defer ul.Close()
+
+	fd, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+
+	c, err := ul.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer c.Close()
+
+	// The idle connection is closed quietly.
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Unexpected error for the idle connection; got %v; expected %v", err, io.EOF)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("HeaderTimeout is not honored; took %v", d)
+	}
+	fd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fd.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed; got %v", err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	ul := &Listener{RequestTimeout: 100 * time.Millisecond}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stall" {
+			time.Sleep(300 * time.Millisecond)
+			w.Write([]byte("late"))
+			return
+		}
+		_, err := ioutil.ReadAll(r.Body)
+		errs <- err
+	}))
+
+	// The body which doesn't arrive in time.
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, map[string]string{
+		"REQUEST_METHOD":  "POST",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"CONTENT_LENGTH":  "10",
+	})
+	fd.Write([]byte("he"))
+	select {
+	case err := <-errs:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("Unexpected error of the body; got %v; expected timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RequestTimeout is not honored for the body")
+	}
+
+	// The response which isn't written in time.
+	fd2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd2.Close()
+	writePacket(fd2, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/stall",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	})
+	fd2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := ioutil.ReadAll(fd2); err != nil || len(b) != 0 {
+		t.Errorf("Expected the connection to be closed without response; got %q, %v", b, err)
+	}
+}
+
+func TestEarlierDeadline(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Second)
+	for _, tc := range []struct {
+		a, b, want time.Time
+	}{
+		{time.Time{}, time.Time{}, time.Time{}},
+		{now, time.Time{}, now},
+		{time.Time{}, now, now},
+		{now, later, now},
+		{later, now, now},
+	} {
+		if got := earlier(tc.a, tc.b); !got.Equal(tc.want) {
+			t.Errorf("earlier(%v, %v) = %v; expected %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestURIFromPathInfo(t *testing.T) {
+	// The front-end encoded "/a b" twice in REQUEST_URI.
+	m := map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/a%2520b?x=1",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"SCRIPT_NAME":     "",
+		"PATH_INFO":       "/a b",
+		"QUERY_STRING":    "x=1",
+	}
+	tests := []struct {
+		fromPathInfo bool
+		path         string
+	}{
+		{false, "/a%20b"},
+		{true, "/a b"},
+	}
+	for _, test := range tests {
+		var path, query string
+		addr := startListener(t, &Listener{URIFromPathInfo: test.fromPathInfo}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, query = r.URL.Path, r.URL.RawQuery
+		}))
+		res := doRequest(t, addr, m, "")
+		res.Body.Close()
+		if path != test.path || query != "x=1" {
+			t.Errorf("Unexpected URL with URIFromPathInfo=%v; got %q %q; expected %q %q", test.fromPathInfo, path, query, test.path, "x=1")
+		}
+	}
+}
+
+func TestStripScriptName(t *testing.T) {
+	tests := []struct {
+		uri, scriptName, pathInfo string
+		fromPathInfo              bool
+		path, mount               string
+	}{
+		{"/app/a/b?x=1", "/app", "/a/b", false, "/a/b", "/app"},
+		{"/app?x=1", "/app", "", false, "/", "/app"},
+		{"/app/a?x=1", "/app/", "/a", false, "/a", "/app"},
+		{"/application/a?x=1", "/app", "", false, "/application/a", "/app"},
+		{"/a?x=1", "", "/a", false, "/a", ""},
+		{"/app/a%2520b?x=1", "/app", "/a b", true, "/a b", "/app"},
+	}
+	for _, test := range tests {
+		var path, query, mount string
+		ul := &Listener{StripScriptName: true, URIFromPathInfo: test.fromPathInfo}
+		addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, query, mount = r.URL.Path, r.URL.RawQuery, ScriptName(r)
+		}))
+		res := doRequest(t, addr, map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"REQUEST_URI":     test.uri,
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+			"SCRIPT_NAME":     test.scriptName,
+			"PATH_INFO":       test.pathInfo,
+			"QUERY_STRING":    "x=1",
+		}, "")
+		res.Body.Close()
+		if path != test.path || query != "x=1" || mount != test.mount {
+			t.Errorf("Unexpected URL for %q; got %q %q %q; expected %q %q %q", test.uri, path, query, mount, test.path, "x=1", test.mount)
+		}
+	}
+}
+
+func TestHeaderTimeoutPartial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	ul := &Listener{Listener: l, HeaderTimeout: 100 * time.Millisecond, InlineParse: true}
+	defer ul.Close()
+
+	fd, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+
+	c, err := ul.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer c.Close()
+
+	// The header declares 100 bytes of vars but only a part is sent.
+	fd.Write([]byte{0, 100, 0, 0})
+	writeKV(fd, "REQUEST_METHOD", "GET")
+	_, err = c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Expected timeout error for the partial vars; got %v", err)
+	}
+}
+
+func TestFallbackHandler(t *testing.T) {
+	ul := &Listener{FallbackHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "http:%s", r.URL.Path)
+	})}
+	addr := startListener(t, ul, ul.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "uwsgi:%s", r.URL.Path)
+	})))
+
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/a",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	}, "")
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "uwsgi:/a" {
+		t.Errorf("Unexpected body for uwsgi; got %q; expected %q", string(body), "uwsgi:/a")
+	}
+
+	res, err := http.Get("http://" + addr + "/b")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "http:/b" {
+		t.Errorf("Unexpected body for raw HTTP; got %q; expected %q", string(body), "http:/b")
+	}
+}
+
+func TestFallbackHandlerKeepAlive(t *testing.T) {
+	ul := &Listener{FallbackHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "http:%s", r.URL.Path)
+	})}
+	addr := startListener(t, ul, ul.Handler(http.NotFoundHandler()))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	fd.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(fd)
+	for _, path := range []string{"/a", "/b"} {
+		fmt.Fprintf(fd, "GET %s HTTP/1.1\r\nHost: localhost\r\n\r\n", path)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response error for %s: %v", path, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if expected := "http:" + path; string(body) != expected {
+			t.Errorf("Unexpected body; got %q; expected %q", string(body), expected)
+		}
+	}
+}
+
+func TestPassengerModifiers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+	ch := make(chan [4]byte, 1)
+	go func() {
+		for {
+			fd, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var head [4]byte
+			io.ReadFull(fd, head[:])
+			io.CopyN(ioutil.Discard, fd, int64(binary.LittleEndian.Uint16(head[1:3])))
+			ch <- head
+			fd.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+			fd.Close()
+		}
+	}()
+
+	tests := []struct {
+		passenger  Passenger
+		mod1, mod2 uint8
+	}{
+		{Passenger{Net: "tcp", Addr: l.Addr().String()}, 0, 0},
+		{Passenger{Net: "tcp", Addr: l.Addr().String(), Modifier1: 5, Modifier2: 1}, 5, 1},
+	}
+	for _, test := range tests {
+		front := httptest.NewServer(test.passenger)
+		res, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		res.Body.Close()
+		front.Close()
+		head := <-ch
+		if head[0] != test.mod1 || head[3] != test.mod2 {
+			t.Errorf("Unexpected modifiers; got %d/%d; expected %d/%d", head[0], head[3], test.mod1, test.mod2)
+		}
+	}
+}
+
+func TestChunkedBody(t *testing.T) {
+	var body string
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read body error: %v", err)
+		}
+		body = string(b)
+	}))
+
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":         "PUT",
+		"REQUEST_URI":            "/upload",
+		"SERVER_PROTOCOL":        "HTTP/1.1",
+		"HTTP_HOST":              "localhost",
+		"HTTP_TRANSFER_ENCODING": "chunked",
+	}, "5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status; got %d; expected %d", res.StatusCode, http.StatusOK)
+	}
+	if body != "hello world" {
+		t.Errorf("Unexpected body; got %q; expected %q", body, "hello world")
+	}
+}
+
+func TestHeaderMap(t *testing.T) {
+	var header http.Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	})
+	m := map[string]string{
+		"REQUEST_METHOD":        "GET",
+		"REQUEST_URI":           "/",
+		"SERVER_PROTOCOL":       "HTTP/1.1",
+		"HTTP_HOST":             "localhost",
+		"HTTP_X_REQUESTED_WITH": "XMLHttpRequest",
+		"UWSGI_APPID":           "app1",
+		"DOCUMENT_ROOT":         "/var/www",
+	}
+
+	res := doRequest(t, startListener(t, &Listener{}, handler), m, "")
+	res.Body.Close()
+	if got := header.Get("X-Requested-With"); got != "XMLHttpRequest" {
+		t.Errorf("Unexpected X-Requested-With by default; got %q", got)
+	}
+	if got := header.Get("DOCUMENT_ROOT"); got != "/var/www" {
+		t.Errorf("Unexpected DOCUMENT_ROOT by default; got %q", got)
+	}
+
+	ul := &Listener{HeaderMap: map[string]string{
+		"UWSGI_APPID":           "X-App-Id",
+		"DOCUMENT_ROOT":         "",
+		"HTTP_X_REQUESTED_WITH": "X-Ajax",
+	}}
+	res = doRequest(t, startListener(t, ul, handler), m, "")
+	res.Body.Close()
+	if got := header.Get("X-App-Id"); got != "app1" {
+		t.Errorf("Unexpected X-App-Id; got %q", got)
+	}
+	if got := header.Get("X-Ajax"); got != "XMLHttpRequest" {
+		t.Errorf("Unexpected X-Ajax; got %q", got)
+	}
+	for _, k := range []string{"DOCUMENT_ROOT", "UWSGI_APPID", "X-Requested-With"} {
+		if _, ok := header[textproto.CanonicalMIMEHeaderKey(k)]; ok {
+			t.Errorf("Unexpected header %s; got %q", k, header.Get(k))
+		}
+	}
+}
+
+func TestZeroContentLength(t *testing.T) {
+	var length int64
+	var header http.Header
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		length = r.ContentLength
+		header = r.Header
+	}))
+
+	m := map[string]string{
+		"REQUEST_METHOD":  "DELETE",
+		"REQUEST_URI":     "/item/1",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"CONTENT_LENGTH":  "0",
+	}
+	res := doRequest(t, addr, m, "")
+	res.Body.Close()
+	if length != 0 || header.Get("Content-Length") != "0" {
+		t.Errorf("Unexpected Content-Length; got %d %q; expected 0", length, header.Get("Content-Length"))
+	}
+
+	// nginx sends empty CONTENT_LENGTH for the request without body.
+	m["CONTENT_LENGTH"] = ""
+	res = doRequest(t, addr, m, "")
+	res.Body.Close()
+	if _, ok := header["Content-Length"]; ok {
+		t.Errorf("Unexpected Content-Length for empty CONTENT_LENGTH; got %q", header.Get("Content-Length"))
+	}
+}
+
+func TestErrorLog(t *testing.T) {
+	var logs syncBuffer
+	errs := make(chan error, 10)
+	ul := &Listener{
+		ErrorLog: log.New(&logs, "", 0),
+		OnError: func(conn net.Conn, err error) {
+			errs <- err
+		},
+	}
+	addr := startListener(t, ul, http.NotFoundHandler())
+
+	// The idle connection is not an error.
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	fd.Close()
+
+	// The packet without SERVER_PROTOCOL.
+	fd, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	writePacket(fd, map[string]string{"REQUEST_METHOD": "GET"})
+
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "no protocol") {
+			t.Errorf("Unexpected error; got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnError is not called")
+	}
+	if got := logs.String(); !strings.Contains(got, "no protocol") || !strings.Contains(got, fd.LocalAddr().String()) {
+		t.Errorf("Unexpected log; got %q", got)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("Unexpected error; got %v", err)
+	default:
+	}
+}
+
+func TestRequestVarsServerPort(t *testing.T) {
+	tests := []struct {
+		target, port, https string
+	}{
+		{"http://example.com/", "80", ""},
+		{"https://example.com/", "443", "on"},
+		{"https://example.com:8443/", "8443", "on"},
+		{"http://[::1]:8080/", "8080", ""},
+		{"https://[::1]/", "443", "on"},
+	}
+	for _, test := range tests {
+		vars := requestVars(httptest.NewRequest("GET", test.target, nil))
+		if got := vars["SERVER_PORT"][0]; got != test.port {
+			t.Errorf("Unexpected SERVER_PORT for %s; got %q; expected %q", test.target, got, test.port)
+		}
+		if got := firstVar(vars, "HTTPS"); got != test.https {
+			t.Errorf("Unexpected HTTPS for %s; got %q; expected %q", test.target, got, test.https)
+		}
+	}
+}
+
+func TestPassengerScriptName(t *testing.T) {
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := Vars(r)
+		fmt.Fprintf(w, "%s|%s|%s", firstVar(vars, "SCRIPT_NAME"), firstVar(vars, "PATH_INFO"), firstVar(vars, "QUERY_STRING"))
+	}))
+
+	tests := []struct {
+		scriptName, path, expected string
+	}{
+		{"", "/app/users?id=1", "|/app/users|id=1"},
+		{"/app", "/app/users?id=1", "/app|/users|id=1"},
+		{"/app/", "/app", "/app||"},
+		{"/app", "/application", "|/application|"},
+	}
+	for _, test := range tests {
+		front := httptest.NewServer(Passenger{Net: "tcp", Addr: addr, ScriptName: test.scriptName})
+		res, err := http.Get(front.URL + test.path)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		front.Close()
+		if string(body) != test.expected {
+			t.Errorf("Unexpected vars for %q and %s; got %q; expected %q", test.scriptName, test.path, string(body), test.expected)
+		}
+	}
+}
+
+func TestPassengerForwardedFor(t *testing.T) {
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := Vars(r)
+		fmt.Fprintf(w, "%s|%s", firstVar(vars, "REMOTE_ADDR"), firstVar(vars, "HTTP_X_FORWARDED_FOR"))
+	}))
+
+	for _, trust := range []bool{false, true} {
+		front := httptest.NewServer(Passenger{Net: "tcp", Addr: addr, TrustForwardedHeaders: trust})
+		req, _ := http.NewRequest("GET", front.URL+"/", nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.1")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		front.Close()
+
+		got := strings.SplitN(string(body), "|", 2)
+		if trust != (got[0] == "203.0.113.7") {
+			t.Errorf("Unexpected REMOTE_ADDR with TrustForwardedHeaders=%v; got %q", trust, got[0])
+		}
+		if expected := "203.0.113.7, 198.51.100.1, 127.0.0.1"; got[1] != expected {
+			t.Errorf("Unexpected X-Forwarded-For; got %q; expected %q", got[1], expected)
+		}
+	}
+}
+
+func TestRequestVarsHostPort(t *testing.T) {
+	tests := []struct {
+		host, name, port string
+	}{
+		{"[2001:db8::1]:443", "2001:db8::1", "443"},
+		{"example.com", "example.com", "80"},
+		{"example.com:8080", "example.com", "8080"},
+		{"[::1]", "::1", "80"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = test.host
+		req.RemoteAddr = "[2001:db8::2]:54321"
+		vars := requestVars(req)
+		if got := vars["SERVER_NAME"][0]; got != test.name {
+			t.Errorf("Unexpected SERVER_NAME for %s; got %q; expected %q", test.host, got, test.name)
+		}
+		if got := vars["SERVER_PORT"][0]; got != test.port {
+			t.Errorf("Unexpected SERVER_PORT for %s; got %q; expected %q", test.host, got, test.port)
+		}
+		if got := vars["HTTP_HOST"][0]; got != test.host {
+			t.Errorf("Unexpected HTTP_HOST; got %q; expected %q", got, test.host)
+		}
+		if got, port := vars["REMOTE_ADDR"][0], vars["REMOTE_PORT"][0]; got != "2001:db8::2" || port != "54321" {
+			t.Errorf("Unexpected REMOTE_ADDR and REMOTE_PORT; got %q %q", got, port)
+		}
+	}
+}
+
+func TestPassengerDial(t *testing.T) {
+	var dialed string
+	p := Passenger{Net: "pipe", Addr: "backend", Dial: func(network, addr string) (net.Conn, error) {
+		dialed = network + ":" + addr
+		front, back := net.Pipe()
+		go ServeConn(back, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("piped " + r.URL.Path))
+		}))
+		return front, nil
+	}}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/x", nil))
+	if dialed != "pipe:backend" {
+		t.Errorf("Unexpected dial; got %q; expected %q", dialed, "pipe:backend")
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "piped /x" {
+		t.Errorf("Unexpected response; got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestPassengerTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	config := srv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	backend := func(wrap func(net.Conn) net.Conn) func(string, string) (net.Conn, error) {
+		return func(network, addr string) (net.Conn, error) {
+			front, back := net.Pipe()
+			go ServeConn(wrap(back), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("secure " + r.URL.Path))
+			}))
+			return front, nil
+		}
+	}
+	tlsBackend := backend(func(c net.Conn) net.Conn {
+		return tls.Server(c, srv.TLS)
+	})
+
+	p := Passenger{Net: "pipe", Addr: "example.com:3031", Dial: tlsBackend, TLSConfig: config}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/x", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "secure /x" {
+		t.Errorf("Unexpected response; got %d %q", w.Code, w.Body.String())
+	}
+
+	p.TLSConfig = &tls.Config{ServerName: "example.com"}
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/x", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Unexpected status for untrusted certificate; got %d; expected %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestConnEnv(t *testing.T) {
+	var env map[string][]string
+	ul := &Listener{}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := r.Context().Value(connContextKey).(*Conn)
+		env = c.Env()
+		env["DOCUMENT_ROOT"][0] = "modified"
+		if v := c.Env()["DOCUMENT_ROOT"]; v[0] != "/var/www" {
+			t.Errorf("Env is not a copy; got %q", v)
+		}
+	}))
+
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"DOCUMENT_ROOT":   "/var/www",
+	}, "")
+	res.Body.Close()
+	if v := env["REQUEST_URI"]; len(v) != 1 || v[0] != "/" {
+		t.Errorf("Unexpected REQUEST_URI; got %q; expected %q", v, "/")
+	}
+
+	c := &Conn{readych: make(chan struct{})}
+	if env := c.Env(); env != nil {
+		t.Errorf("Unexpected env before parse; got %v", env)
+	}
+}
+
+func TestMergeCookies(t *testing.T) {
+	var cookies []*http.Cookie
+	var cookieLines, agents []string
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = r.Cookies()
+		cookieLines, agents = r.Header["Cookie"], r.Header["User-Agent"]
+	}))
+
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	WritePacket(fd, 0, 0, map[string][]string{
+		"REQUEST_METHOD":  {"GET"},
+		"REQUEST_URI":     {"/"},
+		"SERVER_PROTOCOL": {"HTTP/1.1"},
+		"HTTP_HOST":       {"localhost"},
+		"HTTP_COOKIE":     {"a=1", "b=2; c=3"},
+		"HTTP_USER_AGENT": {"first", "second"},
+	})
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	res.Body.Close()
+
+	if len(cookieLines) != 1 || cookieLines[0] != "a=1; b=2; c=3" {
+		t.Errorf("Unexpected Cookie header; got %q; expected %q", cookieLines, "a=1; b=2; c=3")
+	}
+	if len(cookies) != 3 || cookies[0].Name != "a" || cookies[1].Name != "b" || cookies[2].Name != "c" {
+		t.Errorf("Unexpected cookies; got %v", cookies)
+	}
+	if len(agents) != 1 || agents[0] != "first" {
+		t.Errorf("Unexpected User-Agent; got %q; expected %q", agents, "first")
+	}
+}
+
+func TestPassengerTooLargeVars(t *testing.T) {
+	dialed := false
+	p := Passenger{Net: "pipe", Addr: "backend", Dial: func(network, addr string) (net.Conn, error) {
+		dialed = true
+		return nil, io.EOF
+	}}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", "session="+strings.Repeat("x", 70000))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Unexpected status; got %d; expected %d", w.Code, http.StatusBadGateway)
+	}
+	if dialed {
+		t.Error("Backend should not be dialed for the vars which can't be framed")
+	}
+}
+
+func TestMaxEnvSize(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+	ul := &Listener{Listener: l, MaxEnvSize: 100}
+
+	fd, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	// Only the header is sent; the declared vars are never read.
+	fd.Write([]byte{0, 101, 0, 0})
+
+	c, err := ul.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || !strings.Contains(err.Error(), "MaxEnvSize") {
+		t.Errorf("Unexpected error for the datasize over MaxEnvSize; got %v", err)
+	}
+
+	addr := startListener(t, &Listener{MaxEnvSize: 100}, http.NotFoundHandler())
+	res := doRequest(t, addr, testVars, "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Unexpected status for the vars within MaxEnvSize; got %d; expected %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestEncodedRequestURI(t *testing.T) {
+	var u *url.URL
+	var requestURI string
+	addr := startListener(t, &Listener{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, requestURI = r.URL, r.RequestURI
+	}))
+
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"REQUEST_URI":     "/a%2Fb/c%20d?q=x%26y&z=%2F",
+		"PATH_INFO":       "/a/b/c d",
+		"QUERY_STRING":    "q=x%26y&z=%2F",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	}, "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status; got %d", res.StatusCode)
+	}
+	if requestURI != "/a%2Fb/c%20d?q=x%26y&z=%2F" {
+		t.Errorf("Unexpected RequestURI; got %q", requestURI)
+	}
+	if u.Path != "/a/b/c d" || u.EscapedPath() != "/a%2Fb/c%20d" {
+		t.Errorf("Unexpected path; got %q escaped %q", u.Path, u.EscapedPath())
+	}
+	if q := u.Query(); q.Get("q") != "x&y" || q.Get("z") != "/" {
+		t.Errorf("Unexpected query; got %v", q)
+	}
+
+	for _, uri := range []string{"relative/path", "http://[::1/"} {
+		res := doRequest(t, addr, map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"REQUEST_URI":     uri,
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"HTTP_HOST":       "localhost",
+		}, "")
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Unexpected status for %q; got %d; expected %d", uri, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestMissingRequestLine(t *testing.T) {
+	var logs syncBuffer
+	var path string
+	ul := &Listener{ErrorLog: log.New(&logs, "", 0)}
+	addr := startListener(t, ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	}))
+
+	// Without REQUEST_URI, the path is "/".
+	res := doRequest(t, addr, map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+	}, "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || path != "/" {
+		t.Errorf("Unexpected response without REQUEST_URI; got %d %q", res.StatusCode, path)
+	}
+
+	tests := []struct {
+		vars   map[string]string
+		status int
+		msg    string
+	}{
+		{map[string]string{"REQUEST_URI": "/", "SERVER_PROTOCOL": "HTTP/1.1"}, 0, "no method specified"},
+		{map[string]string{"REQUEST_METHOD": "", "REQUEST_URI": "/", "SERVER_PROTOCOL": "HTTP/1.1"}, 0, "no method specified"},
+		{map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": "/"}, 0, "no protocol specified"},
+		{map[string]string{"REQUEST_METHOD": "GE T", "REQUEST_URI": "/", "SERVER_PROTOCOL": "HTTP/1.1"}, http.StatusBadRequest, "malformed REQUEST_METHOD"},
+	}
+	for _, test := range tests {
+		test.vars["HTTP_HOST"] = "localhost"
+		fd, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		writePacket(fd, test.vars)
+		fd.SetReadDeadline(time.Now().Add(5 * time.Second))
+		res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+		switch {
+		case test.status == 0 && err == nil:
+			t.Errorf("Unexpected response for %v; got %d", test.vars, res.StatusCode)
+		case test.status != 0 && (err != nil || res.StatusCode != test.status):
+			t.Errorf("Unexpected response for %v; got %v %v; expected %d", test.vars, res, err, test.status)
+		}
+		fd.Close()
+
+		for i := 0; i < 100; i++ {
+			logged := logs.String()
+			if strings.Contains(logged, test.msg) {
+				break
+			}
+			if i == 99 {
+				t.Errorf("Unexpected log for %v; got %q; expected %q", test.vars, logged, test.msg)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
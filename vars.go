@@ -0,0 +1,136 @@
+package uwsgi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+ * uwsgi vars are linear lists of the form:
+ * struct {
+ *   uint16 key_size;
+ *   uint8  key[key_size];
+ *   uint16 val_size;
+ *   uint8  val[val_size];
+ * }
+ */
+
+// Decoder decode uwsgi vars.
+type Decoder struct {
+	// LengthSize is the size of length prefixes, 2 or 4. Zero means 2;
+	// see Listener.LengthSize.
+	LengthSize int
+
+	// ByteOrder is the byte order of the length prefixes. Nil means
+	// binary.LittleEndian; see Listener.ByteOrder.
+	ByteOrder binary.ByteOrder
+}
+
+// ParseError is the error of the malformed uwsgi vars. Offset is the
+// position in the vars block where the parse failed.
+type ParseError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Invalid uwsgi request; %s at offset %d", e.Msg, e.Offset)
+}
+
+// DecodeVars decode the uwsgi vars block with the standard framing, i.e.
+// 2-byte little-endian length prefixes. For the other framing such as
+// Listener.LengthSize, use Decoder with LengthSize and ByteOrder.
+func DecodeVars(buf []byte) (map[string][]string, error) {
+	return Decoder{}.Decode(buf)
+}
+
+// Decode decode the uwsgi vars block. The vars which have same key are
+// stored in the order of appearance. The block must end exactly at the end
+// of the last var; any premature end is ParseError. The keys and values
+// don't refer to buf.
+func (d Decoder) Decode(buf []byte) (map[string][]string, error) {
+	w := d.LengthSize
+	if w == 0 {
+		w = 2
+	}
+	if w != 2 && w != 4 {
+		return nil, errors.New("Invalid length size of uwsgi vars")
+	}
+
+	// The keys and values are sliced from one copy of the block, and the
+	// first values of keys from one array, so the allocations don't grow
+	// with the number of vars.
+	n := d.count(buf, w)
+	env := make(map[string][]string, n)
+	values := make([]string, 0, n)
+	str := string(buf)
+	i := 0
+	for i < len(buf) {
+		if i+w > len(buf) {
+			return nil, &ParseError{i, fmt.Sprintf("key length needs %d bytes but %d remaining", w, len(buf)-i)}
+		}
+		kl := d.length(buf[i:], w)
+		i += w
+
+		if kl > uint64(len(buf)-i) {
+			return nil, &ParseError{i, fmt.Sprintf("key of %d bytes exceeds %d remaining bytes", kl, len(buf)-i)}
+		}
+		k := str[i : i+int(kl)]
+		i += int(kl)
+
+		if i+w > len(buf) {
+			return nil, &ParseError{i, fmt.Sprintf("value length of %q needs %d bytes but %d remaining", k, w, len(buf)-i)}
+		}
+		vl := d.length(buf[i:], w)
+		i += w
+
+		if vl > uint64(len(buf)-i) {
+			return nil, &ParseError{i, fmt.Sprintf("value of %q of %d bytes exceeds %d remaining bytes", k, vl, len(buf)-i)}
+		}
+		v := str[i : i+int(vl)]
+		i += int(vl)
+
+		if vs, ok := env[k]; ok {
+			env[k] = append(vs, v)
+			continue
+		}
+		// The capacity is limited, so append of the same key copies the
+		// values out of the shared array.
+		values = append(values, v)
+		env[k] = values[len(values)-1 : len(values) : len(values)]
+	}
+	return env, nil
+}
+
+// count returns the number of vars in buf, stopping at the malformed one.
+func (d Decoder) count(buf []byte, w int) int {
+	n, i := 0, 0
+	skip := func() bool {
+		if i+w > len(buf) {
+			return false
+		}
+		l := d.length(buf[i:], w)
+		i += w
+		if l > uint64(len(buf)-i) {
+			return false
+		}
+		i += int(l)
+		return true
+	}
+	for i < len(buf) && skip() && skip() {
+		n++
+	}
+	return n
+}
+
+func (d Decoder) length(b []byte, w int) uint64 {
+	order := d.ByteOrder
+	if order == nil {
+		order = binary.LittleEndian
+	}
+	if w == 4 {
+		return uint64(order.Uint32(b))
+	}
+	return uint64(order.Uint16(b))
+}
@@ -0,0 +1,210 @@
+package uwsgi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// encodeVars4 encode the vars with 4-byte length prefixes.
+func encodeVars4(kv ...string) []byte {
+	var buf []byte
+	var b [4]byte
+	for _, s := range kv {
+		binary.LittleEndian.PutUint32(b[:], uint32(len(s)))
+		buf = append(buf, b[:]...)
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+func TestDecodeVars(t *testing.T) {
+	var buf []byte
+	var b [2]byte
+	for _, s := range []string{"FOO", "bar", "EMPTY", "", "FOO", "baz"} {
+		binary.LittleEndian.PutUint16(b[:], uint16(len(s)))
+		buf = append(buf, b[:]...)
+		buf = append(buf, s...)
+	}
+	env, err := DecodeVars(buf)
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if got := env["FOO"]; len(got) != 2 || got[0] != "bar" || got[1] != "baz" {
+		t.Errorf("Unexpected FOO; got %q", got)
+	}
+	if got, ok := env["EMPTY"]; !ok || got[0] != "" {
+		t.Errorf("Unexpected EMPTY; got %q", got)
+	}
+
+	if _, err := DecodeVars(buf[:len(buf)-5]); err == nil {
+		t.Error("DecodeVars should fail for the truncated vars")
+	}
+
+	// The vars don't refer to buf.
+	for i := range buf {
+		buf[i] = 'x'
+	}
+	if got := env["FOO"]; got[0] != "bar" {
+		t.Errorf("Unexpected FOO after buf is reused; got %q", got)
+	}
+}
+
+func TestDecodeVarsParseError(t *testing.T) {
+	tests := []struct {
+		buf    []byte
+		offset int
+	}{
+		// The value "bar" starts at 7 but only "b" is there.
+		{[]byte("\x03\x00FOO\x03\x00b"), 7},
+		// The key "FOO" starts at 2 but only "F" is there.
+		{[]byte("\x03\x00F"), 2},
+		// The length of the value is cut.
+		{[]byte("\x03\x00FOO\x03"), 5},
+		// The length of the next key is cut after a complete var.
+		{[]byte("\x03\x00FOO\x03\x00bar\x03"), 10},
+	}
+	for _, test := range tests {
+		_, err := DecodeVars(test.buf)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected ParseError for %q; got %v", test.buf, err)
+			continue
+		}
+		if pe.Offset != test.offset {
+			t.Errorf("Unexpected offset for %q; got %d; expected %d: %v", test.buf, pe.Offset, test.offset, pe)
+		}
+	}
+}
+
+func TestDecodeVarsLengthSize4(t *testing.T) {
+	env, err := Decoder{LengthSize: 4}.Decode(encodeVars4("FOO", "bar", "BAZ", "qux"))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if env["FOO"][0] != "bar" || env["BAZ"][0] != "qux" {
+		t.Errorf("Unexpected vars; got %q", env)
+	}
+}
+
+func TestListenerLengthSize4(t *testing.T) {
+	var gotPath string
+	addr := startListener(t, &Listener{LengthSize: 4}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+
+	vars := encodeVars4(
+		"REQUEST_METHOD", "GET",
+		"REQUEST_URI", "/four",
+		"SERVER_PROTOCOL", "HTTP/1.1",
+		"HTTP_HOST", "localhost",
+	)
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	var head [4]byte
+	binary.LittleEndian.PutUint16(head[1:3], uint16(len(vars)))
+	fd.Write(head[:])
+	fd.Write(vars)
+
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	res.Body.Close()
+	if gotPath != "/four" {
+		t.Errorf("Unexpected path; got %q; expected %q", gotPath, "/four")
+	}
+}
+
+// TestDatasizeMismatch send the packet whose datasize disagrees with the
+// vars in it.
+func TestDatasizeMismatch(t *testing.T) {
+	vars := []byte("\x0e\x00REQUEST_METHOD\x03\x00GET")
+	tests := []struct {
+		name     string
+		datasize int
+	}{
+		// The last byte of the value is out of the vars block.
+		{"short", len(vars) - 1},
+		// The first byte of the body is in the vars block.
+		{"long", len(vars) + 1},
+	}
+	for _, test := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen error: %v", err)
+		}
+		ul := &Listener{Listener: l}
+
+		fd, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		head := []byte{0, 0, 0, 0}
+		binary.LittleEndian.PutUint16(head[1:3], uint16(test.datasize))
+		fd.Write(append(append(head, vars...), "body"...))
+
+		c, err := ul.Accept()
+		if err != nil {
+			t.Fatalf("accept error: %v", err)
+		}
+		_, err = c.Read(make([]byte, 1))
+		if _, ok := err.(*ParseError); !ok {
+			t.Errorf("Unexpected error for %s datasize; got %v; expected ParseError", test.name, err)
+		}
+		c.Close()
+		fd.Close()
+		l.Close()
+	}
+}
+
+func TestByteOrder(t *testing.T) {
+	var vars []byte
+	for _, s := range []string{"REQUEST_METHOD", "GET", "REQUEST_URI", "/big", "SERVER_PROTOCOL", "HTTP/1.1", "HTTP_HOST", "localhost"} {
+		vars = append(vars, byte(len(s)>>8), byte(len(s)))
+		vars = append(vars, s...)
+	}
+	head := []byte{0, 0, 0, 0}
+	binary.BigEndian.PutUint16(head[1:3], uint16(len(vars)))
+
+	addr := startListener(t, &Listener{ByteOrder: binary.BigEndian}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	fd, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer fd.Close()
+	fd.Write(append(head, vars...))
+
+	res, err := http.ReadResponse(bufio.NewReader(fd), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "/big" {
+		t.Errorf("Unexpected body; got %q; expected %q", string(body), "/big")
+	}
+}
+
+func BenchmarkDecodeVars(b *testing.B) {
+	var packet bytes.Buffer
+	WritePacket(&packet, 0, 0, benchmarkEnv(40))
+	buf := packet.Bytes()[4:]
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := DecodeVars(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}